@@ -0,0 +1,92 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// authorizerContext maps the configured headers onto authorizer context
+// keys. Missing headers produce no key; it returns nil when nothing matched.
+func (rt *LambdaRequestTransformer) authorizerContext(header http.Header) map[string]string {
+	var ctx map[string]string
+	for h, key := range rt.authorizerHeaders {
+		value := header.Get(h)
+		if value == "" {
+			continue
+		}
+		if ctx == nil {
+			ctx = make(map[string]string, len(rt.authorizerHeaders))
+		}
+		ctx[key] = value
+	}
+	return ctx
+}
+
+// jwtAuthorizer decodes the claims of a bearer JWT into the shape of API
+// Gateway's JWT authorizer context. The signature is not verified; that is
+// expected to have happened upstream. It returns nil when the header holds
+// no well-formed token.
+func jwtAuthorizer(authorization string) map[string]interface{} {
+	const scheme = "bearer "
+	if len(authorization) <= len(scheme) || !strings.EqualFold(authorization[:len(scheme)], scheme) {
+		return nil
+	}
+
+	parts := strings.Split(strings.TrimSpace(authorization[len(scheme):]), ".")
+	if len(parts) != 3 {
+		return nil
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return nil
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil || claims == nil {
+		return nil
+	}
+
+	// Scopes come from the space-delimited "scope" claim or an "scp" array
+	var scopes []string
+	switch v := claims["scope"].(type) {
+	case string:
+		scopes = strings.Fields(v)
+	}
+	if scp, ok := claims["scp"].([]interface{}); ok {
+		for _, s := range scp {
+			if str, ok := s.(string); ok {
+				scopes = append(scopes, str)
+			}
+		}
+	}
+
+	return map[string]interface{}{
+		"claims": claims,
+		"scopes": scopes,
+	}
+}
+
+// clientCertInfo describes the leaf peer certificate of a mutual TLS
+// connection in API Gateway's clientCert shape. It returns nil for non-TLS
+// requests or when the client presented no certificate.
+func clientCertInfo(state *tls.ConnectionState) map[string]interface{} {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := state.PeerCertificates[0]
+
+	return map[string]interface{}{
+		"clientCertPem": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw})),
+		"subjectDN":     leaf.Subject.String(),
+		"issuerDN":      leaf.Issuer.String(),
+		"serialNumber":  leaf.SerialNumber.String(),
+		"validity": map[string]interface{}{
+			"notBefore": leaf.NotBefore.UTC().Format(time.RFC3339),
+			"notAfter":  leaf.NotAfter.UTC().Format(time.RFC3339),
+		},
+	}
+}
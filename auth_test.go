@@ -0,0 +1,74 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// token assembles a JWT from a raw payload; the signature isn't checked.
+func token(payload string) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+}
+
+func TestJWTAuthorizerClaims(t *testing.T) {
+	got := jwtAuthorizer("Bearer " + token(`{"sub":"user-1","scope":"read write","scp":["admin"]}`))
+	if got == nil {
+		t.Fatal("well-formed token produced no authorizer")
+	}
+	claims := got["claims"].(map[string]interface{})
+	if claims["sub"] != "user-1" {
+		t.Errorf("claims = %v", claims)
+	}
+	if scopes := got["scopes"]; !reflect.DeepEqual(scopes, []string{"read", "write", "admin"}) {
+		t.Errorf("scopes = %v", scopes)
+	}
+
+	// The scheme is case-insensitive and padding is tolerated
+	if jwtAuthorizer("bearer "+token(`{"sub":"x"}`)+"==") == nil {
+		t.Error("lowercase scheme rejected")
+	}
+}
+
+func TestJWTAuthorizerMalformedTokens(t *testing.T) {
+	tests := map[string]string{
+		"empty":                "",
+		"no scheme":            token(`{"sub":"x"}`),
+		"basic scheme":         "Basic dXNlcjpwYXNz",
+		"scheme only":          "Bearer ",
+		"two segments":         "Bearer aGVhZGVy.eyJzdWIiOiJ4In0",
+		"four segments":        "Bearer " + token(`{"sub":"x"}`) + ".extra",
+		"bad base64":           "Bearer aGVhZGVy.!!!not-base64!!!.c2ln",
+		"payload not JSON":     "Bearer " + token(`not json`),
+		"payload array":        "Bearer " + token(`["sub","x"]`),
+		"payload string":       "Bearer " + token(`"sub"`),
+		"payload null":         "Bearer " + token(`null`),
+		"payload number":       "Bearer " + token(`42`),
+		"truncated JSON":       "Bearer " + token(`{"sub":`),
+		"empty payload":        "Bearer aGVhZGVy..c2ln",
+		"standard base64 plus": "Bearer aGVhZGVy.eyJzdWIiOiI+In0+.c2ln",
+	}
+	for name, authorization := range tests {
+		if got := jwtAuthorizer(authorization); got != nil {
+			t.Errorf("%s: got %v, want nil", name, got)
+		}
+	}
+}
+
+func TestMalformedJWTLeavesNoAuthorizer(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.JWTAuthorizer = true
+	for _, authorization := range []string{"Bearer a.b", "Bearer aGVhZGVy.!!!.c2ln", "Bearer " + token(`[1,2]`)} {
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		req.Header.Set("Authorization", authorization)
+		event := eventFor(t, cfg, req, fixedTime, "req-1")
+
+		reqCtx := event["requestContext"].(map[string]interface{})
+		if authorizer, ok := reqCtx["authorizer"]; ok {
+			t.Errorf("%q: authorizer = %v, want none", authorization, authorizer)
+		}
+	}
+}
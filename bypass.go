@@ -0,0 +1,88 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// bypass reports whether the request should be forwarded untouched instead
+// of being turned into a Lambda event.
+func (rt *LambdaRequestTransformer) bypass(req *http.Request) bool {
+	// A protocol upgrade (e.g. a WebSocket handshake) has no event form
+	if isUpgrade(req) {
+		return true
+	}
+	// gRPC framing is length-prefixed binary that a Lambda event would break
+	if isGRPC(req) {
+		return true
+	}
+	if strings.EqualFold(strings.TrimSpace(req.Header.Get(rt.optOutHeader)), "off") {
+		return true
+	}
+	if rt.transformMethods != nil && !rt.transformMethods[req.Method] {
+		return true
+	}
+	return rt.skipPath(req.URL.Path)
+}
+
+// isUpgrade reports whether the request asks to switch protocols, i.e. it
+// carries an Upgrade header and lists "upgrade" in Connection.
+func isUpgrade(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isGRPC reports whether the request is gRPC or gRPC-Web, i.e. its
+// Content-Type is application/grpc or application/grpc-web, optionally with
+// a "+proto"-style suffix or parameters.
+func isGRPC(req *http.Request) bool {
+	ct := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Type")))
+	if i := strings.IndexAny(ct, ";+"); i != -1 {
+		ct = strings.TrimSpace(ct[:i])
+	}
+	switch ct {
+	case "application/grpc", "application/grpc-web", "application/grpc-web-text":
+		return true
+	}
+	return false
+}
+
+// skipPath reports whether path matches one of the SkipPaths entries. An
+// entry matches the path itself and everything below it, segment-wise:
+// "/health" matches "/health" and "/health/live" but not "/healthz".
+func (rt *LambdaRequestTransformer) skipPath(path string) bool {
+	for _, p := range rt.skipPaths {
+		if path == p {
+			return true
+		}
+		prefix := p
+		if !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// methodSet builds a lookup set of upper-cased HTTP methods.
+func methodSet(methods []string) map[string]bool {
+	if len(methods) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(methods))
+	for _, m := range methods {
+		set[strings.ToUpper(strings.TrimSpace(m))] = true
+	}
+	return set
+}
@@ -0,0 +1,90 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// forwarded is what the next handler saw of a request.
+type forwarded struct {
+	method, path  string
+	header        http.Header
+	contentLength int64
+	body          []byte
+}
+
+// forward runs req through a transformer built from cfg and records what
+// reached the next handler.
+func forward(t *testing.T, cfg *Config, req *http.Request) forwarded {
+	t.Helper()
+	var got *forwarded
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+		got = &forwarded{req.Method, req.URL.Path, req.Header.Clone(), req.ContentLength, body}
+	})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if got == nil {
+		t.Fatal("next not called")
+	}
+	return *got
+}
+
+func TestUpgradeRequestsAreNotTransformed(t *testing.T) {
+	body := []byte("client bytes")
+	req := httptest.NewRequest(http.MethodGet, "/socket", bytes.NewReader(body))
+	req.Header.Set("Connection", "keep-alive, Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+
+	got := forward(t, CreateConfig(), req)
+	if got.method != http.MethodGet {
+		t.Errorf("method = %q, want GET", got.method)
+	}
+	if got.path != "/socket" {
+		t.Errorf("path = %q, want /socket", got.path)
+	}
+	if !bytes.Equal(got.body, body) {
+		t.Errorf("body = %q, want %q", got.body, body)
+	}
+	if got.header.Get("Upgrade") != "websocket" || got.header.Get("Connection") != "keep-alive, Upgrade" {
+		t.Errorf("upgrade headers changed: %v", got.header)
+	}
+	if got.header.Get("X-Original-Method") != "" {
+		t.Error("upgrade request was marked as transformed")
+	}
+}
+
+func TestGRPCWebRequestsAreNotTransformed(t *testing.T) {
+	// One length-prefixed gRPC-Web data frame: flag, 4-byte length, message
+	frame := []byte{0x00, 0x00, 0x00, 0x00, 0x05, 0x0a, 0x03, 'f', 'o', 'o'}
+	for _, ct := range []string{"application/grpc-web+proto", "application/grpc-web-text", "application/grpc"} {
+		req := httptest.NewRequest(http.MethodPost, "/pkg.Service/Method", bytes.NewReader(frame))
+		req.Header.Set("Content-Type", ct)
+		req.Header.Set("X-Grpc-Web", "1")
+
+		got := forward(t, CreateConfig(), req)
+		if got.method != http.MethodPost || got.path != "/pkg.Service/Method" {
+			t.Errorf("%s: forwarded as %s %s", ct, got.method, got.path)
+		}
+		if !bytes.Equal(got.body, frame) {
+			t.Errorf("%s: body = %x, want %x", ct, got.body, frame)
+		}
+		if got.contentLength != int64(len(frame)) {
+			t.Errorf("%s: ContentLength = %d, want %d", ct, got.contentLength, len(frame))
+		}
+		if got.header.Get("Content-Type") != ct {
+			t.Errorf("%s: Content-Type = %q", ct, got.header.Get("Content-Type"))
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// isPreflight reports whether req is a CORS preflight request.
+func isPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions &&
+		req.Header.Get("Origin") != "" &&
+		req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// servePreflight answers a CORS preflight request with 204 without invoking
+// the Lambda. Disallowed origins get no CORS headers, so the browser blocks
+// the actual request.
+func (rt *LambdaRequestTransformer) servePreflight(rw http.ResponseWriter, req *http.Request) {
+	origin := req.Header.Get("Origin")
+	h := rw.Header()
+	h.Add("Vary", "Origin")
+
+	allowed := ""
+	for _, o := range rt.allowOrigins {
+		if o == "*" {
+			allowed = "*"
+			break
+		}
+		if strings.EqualFold(o, origin) {
+			allowed = origin
+			break
+		}
+	}
+	if allowed == "" {
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.Set("Access-Control-Allow-Origin", allowed)
+	if rt.allowMethods != "" {
+		h.Set("Access-Control-Allow-Methods", rt.allowMethods)
+	} else {
+		h.Set("Access-Control-Allow-Methods", req.Header.Get("Access-Control-Request-Method"))
+	}
+	if rt.allowHeaders != "" {
+		h.Set("Access-Control-Allow-Headers", rt.allowHeaders)
+	} else if requested := req.Header.Get("Access-Control-Request-Headers"); requested != "" {
+		h.Set("Access-Control-Allow-Headers", requested)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
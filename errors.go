@@ -0,0 +1,83 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// errorBody is the JSON envelope of error responses.
+type errorBody struct {
+	Error     string `json:"error"`
+	Detail    string `json:"detail,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// transformError is a failure to build the event, carrying the status and
+// client-facing message ServeHTTP answers with. A statusClientClosedRequest
+// status means the client went away and nothing should be written but it.
+type transformError struct {
+	status int
+	msg    string
+	err    error
+}
+
+func (e *transformError) Error() string {
+	return e.err.Error()
+}
+
+func (e *transformError) Unwrap() error {
+	return e.err
+}
+
+// clientRequestKey is the context key of the client's clientRequest.
+type clientRequestKey struct{}
+
+// clientRequest is the method and path the client sent, before ServeHTTP
+// rewrote them.
+type clientRequest struct {
+	method, path string
+}
+
+// clientMethodPath returns the method and path the client sent, for logs
+// written after the request has been rewritten.
+func clientMethodPath(req *http.Request) (method, path string) {
+	if cr, ok := req.Context().Value(clientRequestKey{}).(clientRequest); ok {
+		return cr.method, cr.path
+	}
+	return req.Method, req.URL.Path
+}
+
+// report counts and logs err and hands it to OnError. It returns the
+// request id for the response.
+func (rt *LambdaRequestTransformer) report(req *http.Request, status int, err error) string {
+	rt.metrics.failed()
+
+	requestID, _ := RequestIDFromContext(req.Context())
+	method, path := clientMethodPath(req)
+	rt.logger.Printf("name=%s method=%s path=%q requestId=%s status=%d error=%q",
+		rt.name, method, path, requestID, status, err.Error())
+
+	if rt.OnError != nil {
+		rt.OnError(req, err)
+	}
+	return requestID
+}
+
+// fail reports a transformation error: it counts and logs err, hands it to
+// OnError, then answers the client with status and a JSON envelope holding
+// msg and the request id. msg is what the client sees, so it must not carry
+// internal details; err's text is only added with VerboseErrors.
+func (rt *LambdaRequestTransformer) fail(rw http.ResponseWriter, req *http.Request, status int, msg string, err error) {
+	requestID := rt.report(req, status, err)
+
+	body := errorBody{Error: msg, RequestID: requestID}
+	if rt.verboseErrors {
+		body.Detail = err.Error()
+	}
+	// Drop headers meant for the response that was not sent
+	rw.Header().Del("Content-Length")
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(status)
+	_ = json.NewEncoder(rw).Encode(body)
+}
@@ -0,0 +1,661 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// requestInfo holds the request details captured before the request is
+// rewritten, from which the Lambda event is built.
+type requestInfo struct {
+	method        string
+	path          string
+	rawQuery      string
+	routeKey      string
+	resource      string
+	pathParams    map[string]string
+	query         url.Values
+	header        http.Header
+	headers       map[string]string
+	domainName    string
+	domainPrefix  string
+	protocol      string
+	scheme        string
+	rawURL        string
+	sourceIP      string
+	userAgent     string
+	authorization string
+	authorizerCtx map[string]string
+	clientCert    map[string]interface{}
+	identitySrc   []string
+	cookies       []string
+	requestID     string
+	now           time.Time
+	body          string
+	isBase64      bool
+	bodyTooLarge  bool
+}
+
+// buildV2Event builds an API Gateway HTTP API (payload format 2.0) event.
+func (rt *LambdaRequestTransformer) buildV2Event(info *requestInfo) map[string]interface{} {
+	routeKey := info.routeKey
+
+	// Cookies travel in their own field in 2.0 events, not in headers
+	delete(info.headers, rt.headerKey("Cookie"))
+
+	event := map[string]interface{}{
+		"version":        payloadVersion2,
+		"type":           "REQUEST",
+		"routeKey":       routeKey,
+		"rawPath":        info.path,
+		"rawQueryString": info.rawQuery,
+		"headers":        info.headers,
+		"requestContext": map[string]interface{}{
+			"accountId":    rt.accountID,
+			"apiId":        rt.apiID,
+			"domainName":   info.domainName,
+			"domainPrefix": info.domainPrefix,
+			"http": map[string]interface{}{
+				"method":    info.method,
+				"path":      info.path,
+				"protocol":  info.protocol,
+				"scheme":    info.scheme,
+				"sourceIp":  info.sourceIP,
+				"userAgent": info.userAgent,
+			},
+			"requestId": info.requestID,
+			"routeKey":  routeKey,
+			"stage":     rt.stage,
+			"time":      info.now.Format(rt.timeLayout),
+			"timeEpoch": info.now.UnixMilli(),
+		},
+		"body":            info.body,
+		"isBase64Encoded": info.isBase64,
+		"identitySource":  info.identitySrc,
+	}
+
+	// API Gateway omits queryStringParameters when there are none
+	if params := singleValueQuery(info.query); params != nil {
+		event["queryStringParameters"] = params
+	}
+	if len(info.pathParams) > 0 {
+		event["pathParameters"] = info.pathParams
+	}
+	authorizer := map[string]interface{}{}
+	if rt.jwtAuthorizer {
+		if jwt := jwtAuthorizer(info.authorization); jwt != nil {
+			authorizer["jwt"] = jwt
+		}
+	}
+	if len(info.authorizerCtx) > 0 {
+		authorizer["lambda"] = info.authorizerCtx
+	}
+	if len(authorizer) > 0 {
+		event["requestContext"].(map[string]interface{})["authorizer"] = authorizer
+	}
+	if info.clientCert != nil {
+		event["requestContext"].(map[string]interface{})["authentication"] = map[string]interface{}{
+			"clientCert": info.clientCert,
+		}
+	}
+	if len(rt.stageVariables) > 0 {
+		event["stageVariables"] = rt.stageVariables
+	}
+	if len(info.cookies) > 0 {
+		event["cookies"] = info.cookies
+	}
+	if rt.includeMultiValueQuery {
+		if params := multiValueQuery(info.query); params != nil {
+			event["multiValueQueryStringParameters"] = params
+		}
+	}
+
+	return event
+}
+
+// buildV1Event builds an API Gateway REST API proxy (payload format 1.0) event.
+func (rt *LambdaRequestTransformer) buildV1Event(info *requestInfo) map[string]interface{} {
+	event := map[string]interface{}{
+		"version":                         payloadVersion1,
+		"resource":                        info.resource,
+		"path":                            info.path,
+		"httpMethod":                      info.method,
+		"headers":                         rt.singleValueHeaders(info.header),
+		"multiValueHeaders":               multiValueHeaders(info.header),
+		"queryStringParameters":           singleValueQuery(info.query),
+		"multiValueQueryStringParameters": multiValueQuery(info.query),
+		"pathParameters":                  nilIfEmpty(info.pathParams),
+		"stageVariables":                  nilIfEmpty(rt.stageVariables),
+		"requestContext": map[string]interface{}{
+			"accountId":    rt.accountID,
+			"apiId":        rt.apiID,
+			"domainName":   info.domainName,
+			"domainPrefix": info.domainPrefix,
+			"httpMethod":   info.method,
+			"identity": map[string]interface{}{
+				"sourceIp":   info.sourceIP,
+				"userAgent":  info.userAgent,
+				"clientCert": info.clientCert,
+			},
+			"path":             info.path,
+			"protocol":         info.protocol,
+			"scheme":           info.scheme,
+			"requestId":        info.requestID,
+			"requestTime":      info.now.Format(rt.timeLayout),
+			"requestTimeEpoch": info.now.UnixMilli(),
+			"resourcePath":     info.resource,
+			"stage":            rt.stage,
+		},
+		"body":            info.body,
+		"isBase64Encoded": info.isBase64,
+	}
+
+	// REST API custom authorizers expose their context keys directly
+	if len(info.authorizerCtx) > 0 {
+		authorizer := make(map[string]string, len(info.authorizerCtx))
+		for k, v := range info.authorizerCtx {
+			authorizer[k] = v
+		}
+		event["requestContext"].(map[string]interface{})["authorizer"] = authorizer
+	}
+
+	return event
+}
+
+// buildFunctionURLEvent builds a Lambda function URL event. It shares the 2.0
+// shape but has no routeKey or stage, and carries an IAM authorizer block
+// when the request is SigV4-signed.
+func (rt *LambdaRequestTransformer) buildFunctionURLEvent(info *requestInfo) map[string]interface{} {
+	event := rt.buildV2Event(info)
+	delete(event, "routeKey")
+
+	reqCtx := event["requestContext"].(map[string]interface{})
+	delete(reqCtx, "routeKey")
+	delete(reqCtx, "stage")
+
+	if iam := sigV4Identity(info.header.Get("Authorization")); iam != nil {
+		reqCtx["authorizer"] = map[string]interface{}{"iam": iam}
+	}
+	return event
+}
+
+// sigV4Identity extracts the caller's access key from a SigV4 Authorization
+// header. It returns nil when the request isn't signed.
+func sigV4Identity(authorization string) map[string]interface{} {
+	const scheme = "AWS4-HMAC-SHA256 "
+	if !strings.HasPrefix(authorization, scheme) {
+		return nil
+	}
+
+	accessKey := ""
+	for _, part := range strings.Split(authorization[len(scheme):], ",") {
+		part = strings.TrimSpace(part)
+		if strings.HasPrefix(part, "Credential=") {
+			credential := strings.TrimPrefix(part, "Credential=")
+			if i := strings.Index(credential, "/"); i != -1 {
+				credential = credential[:i]
+			}
+			accessKey = credential
+		}
+	}
+
+	// Only the access key is known locally; the rest needs IAM to resolve
+	return map[string]interface{}{
+		"accessKey":       accessKey,
+		"accountId":       nil,
+		"callerId":        nil,
+		"cognitoIdentity": nil,
+		"principalOrgId":  nil,
+		"userArn":         nil,
+		"userId":          nil,
+	}
+}
+
+// buildALBEvent builds an Application Load Balancer target group event.
+func (rt *LambdaRequestTransformer) buildALBEvent(info *requestInfo) map[string]interface{} {
+	// ALB delivers lowercased, single-value headers
+	headers := make(map[string]string, len(info.header))
+	for h, values := range info.header {
+		if len(values) > 0 {
+			headers[strings.ToLower(h)] = values[len(values)-1]
+		}
+	}
+
+	query := singleValueQuery(info.query)
+	if query == nil {
+		query = map[string]string{}
+	}
+
+	return map[string]interface{}{
+		"requestContext": map[string]interface{}{
+			"elb": map[string]interface{}{
+				"targetGroupArn": rt.targetGroupARN,
+			},
+		},
+		"httpMethod":            info.method,
+		"path":                  info.path,
+		"queryStringParameters": query,
+		"headers":               headers,
+		"body":                  info.body,
+		"isBase64Encoded":       info.isBase64,
+	}
+}
+
+// parseDomain splits a Host header value into the domain name (without
+// port) and its first label. IPv6 literals such as "[::1]:8080" yield "::1";
+// IP addresses are their own prefix.
+func parseDomain(host string) (domainName, domainPrefix string) {
+	domainName = host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		domainName = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		domainName = host[1 : len(host)-1] // bracketed IPv6 without port
+	}
+
+	if net.ParseIP(domainName) != nil {
+		return domainName, domainName
+	}
+	if i := strings.Index(domainName, "."); i != -1 {
+		return domainName, domainName[:i]
+	}
+	return domainName, domainName
+}
+
+// nilIfEmpty returns nil for an empty map so it marshals as null.
+func nilIfEmpty(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	return m
+}
+
+// splitCookies splits every Cookie header value into individual trimmed
+// "name=value" pairs.
+func splitCookies(header http.Header) []string {
+	var cookies []string
+	for _, line := range header.Values("Cookie") {
+		for _, pair := range strings.Split(line, ";") {
+			if pair = strings.TrimSpace(pair); pair != "" {
+				cookies = append(cookies, pair)
+			}
+		}
+	}
+	return cookies
+}
+
+// singleValueHeaders maps each header to its last value, as the 1.0 format
+// does, with keys in the configured casing.
+func (rt *LambdaRequestTransformer) singleValueHeaders(header http.Header) map[string]string {
+	out := make(map[string]string, len(header))
+	for h, values := range header {
+		if len(values) > 0 {
+			out[rt.headerKey(h)] = values[len(values)-1]
+		}
+	}
+	return out
+}
+
+// multiValueHeaders copies the request headers, keeping every value. It
+// returns nil when there are no headers so the field marshals as null.
+func multiValueHeaders(header http.Header) map[string][]string {
+	if len(header) == 0 {
+		return nil
+	}
+	out := make(map[string][]string, len(header))
+	for h, values := range header {
+		out[h] = append([]string(nil), values...)
+	}
+	return out
+}
+
+// singleValueQuery maps each query key to its last value, as API Gateway
+// does. Keys without a value (e.g. "?flag") are omitted. It returns nil when
+// no parameters remain.
+func singleValueQuery(query url.Values) map[string]string {
+	out := make(map[string]string, len(query))
+	for k, values := range query {
+		if len(values) == 0 || values[len(values)-1] == "" {
+			continue
+		}
+		out[k] = values[len(values)-1]
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// multiValueQuery maps each query key to all of its values in order. It
+// returns nil when there are no parameters.
+func multiValueQuery(query url.Values) map[string][]string {
+	if len(query) == 0 {
+		return nil
+	}
+	out := make(map[string][]string, len(query))
+	for k, values := range query {
+		if len(values) == 0 {
+			continue
+		}
+		out[k] = values
+	}
+	return out
+}
+
+// encodeEvent builds the event for info in the configured format, or renders
+// the event template when one is set, and returns the JSON payload.
+func (rt *LambdaRequestTransformer) encodeEvent(info *requestInfo, rawBody []byte, contentType string) ([]byte, error) {
+	payload, err := rt.marshalEvent(info, rawBody, contentType)
+	if err != nil || !rt.sortEventKeys {
+		return payload, err
+	}
+	return sortedJSON(payload)
+}
+
+// marshalEvent does the work of encodeEvent, without key sorting.
+func (rt *LambdaRequestTransformer) marshalEvent(info *requestInfo, rawBody []byte, contentType string) ([]byte, error) {
+	if rt.eventTemplate != nil {
+		return rt.renderEventTemplate(info)
+	}
+	return marshalJSON(rt.eventMap(info, rawBody, contentType))
+}
+
+// eventMap builds the built-in event for info in the configured format.
+func (rt *LambdaRequestTransformer) eventMap(info *requestInfo, rawBody []byte, contentType string) map[string]interface{} {
+	var event map[string]interface{}
+	switch {
+	case rt.eventFormat == eventFormatALB:
+		event = rt.buildALBEvent(info)
+	case rt.eventFormat == eventFormatFunctionURL:
+		event = rt.buildFunctionURLEvent(info)
+	case rt.payloadVersion == payloadVersion1:
+		event = rt.buildV1Event(info)
+	default:
+		event = rt.buildV2Event(info)
+	}
+
+	// Every format has a requestContext map
+	reqCtx := event["requestContext"].(map[string]interface{})
+	if rt.includeMiddlewareName {
+		reqCtx["middlewareName"] = orDefault(rt.routerName, rt.name)
+	}
+	if info.rawURL != "" {
+		reqCtx["rawRequestURL"] = info.rawURL
+	}
+
+	// Embed JSON bodies as objects for runtimes that skip the string decode
+	if rt.inlineJSONBody && !info.bodyTooLarge && isJSONContentType(contentType) && json.Valid(rawBody) {
+		event["bodyJSON"] = json.RawMessage(rawBody)
+	}
+	// The body is already capped by maxBodyBytes; malformed pairs are skipped
+	if rt.parseFormBody && !info.bodyTooLarge && isFormContentType(contentType) {
+		if form, _ := url.ParseQuery(string(rawBody)); len(form) > 0 {
+			event["formParameters"] = map[string][]string(form)
+		}
+	}
+	if info.bodyTooLarge {
+		event["bodyTooLarge"] = true
+	}
+	if rt.eventKeyStyle == keyStyleSnake {
+		snakeCaseKeys(event)
+	}
+	return event
+}
+
+// builtEvent is the serialized event for one request plus what ServeHTTP
+// needs to forward it; payload is empty until buildEvent encodes it.
+// release must be called once the request is done.
+type builtEvent struct {
+	payload []byte
+	info    *requestInfo
+	// body is the buffered client body; nil when stream carries it
+	body   []byte
+	stream *streamedBody
+
+	release func()
+}
+
+// buildEvent turns a request that has not been rewritten yet into the
+// serialized event: prepareEvent, then encodeEvent. It is the whole of
+// what ServeHTTP does before rewriting the request, so tests exercise the
+// real pipeline by calling it. Errors are *transformError.
+func (rt *LambdaRequestTransformer) buildEvent(req *http.Request, now time.Time, requestID string) (*builtEvent, error) {
+	built, err := rt.prepareEvent(req, now, requestID)
+	if err != nil {
+		return nil, err
+	}
+	// Construct and serialize the event
+	payload, err := rt.encodeEvent(built.info, built.body, req.Header.Get("Content-Type"))
+	if err != nil {
+		built.release()
+		return nil, &transformError{status: http.StatusInternalServerError, msg: "internal error building Lambda event", err: fmt.Errorf("event encoding: %w", err)}
+	}
+	built.payload = payload
+	return built, nil
+}
+
+// prepareEvent gathers everything the event is built from: it enforces the
+// header limits, applies InjectHeaders and the promotions, and reads,
+// streams or spills the body. The returned builtEvent has no payload yet;
+// eventMap (or encodeEvent) of its info and body gives the event. Errors
+// are *transformError.
+func (rt *LambdaRequestTransformer) prepareEvent(req *http.Request, now time.Time, requestID string) (*builtEvent, error) {
+	// Refuse oversized header sets before copying them anywhere. Only the
+	// client's own headers count: what we inject or promote is config.
+	if !rt.headersWithinLimits(req.Header) {
+		return nil, &transformError{status: http.StatusRequestHeaderFieldsTooLarge, msg: "request header fields too large", err: errHeadersTooLarge}
+	}
+
+	// The URL as the client sent it, before promoted parameters are added
+	rawURL := rt.rawRequestURL(req)
+	rt.injectHeaders(req)
+	rt.promote(req)
+
+	if err := req.Context().Err(); err != nil {
+		return nil, &transformError{status: statusClientClosedRequest, err: err}
+	}
+
+	built := &builtEvent{release: func() {}}
+	// Until eventReader takes a streamed body over, release closes it; a
+	// spilled file is removed in any case
+	abort := func(err *transformError) (*builtEvent, error) {
+		built.release()
+		return nil, err
+	}
+
+	// Read the client body (if any), capped so a lying Content-Length can't
+	// make us buffer more than the limit. In stream mode only the declared
+	// length is checked here; the body is spliced into the event on the fly.
+	if rt.streamBody && req.Body != nil && req.Body != http.NoBody {
+		if rt.maxBodyBytes > 0 && req.ContentLength > rt.maxBodyBytes {
+			req.Body.Close()
+			return nil, &transformError{status: http.StatusRequestEntityTooLarge, msg: errBodyTooLarge.Error(), err: errBodyTooLarge}
+		}
+		stream := &streamedBody{
+			src:         req.Body,
+			placeholder: newBodyPlaceholder(),
+			gunzip:      rt.decompressRequest && strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip"),
+		}
+		stream.base64 = !rt.isTextContentType(req.Header.Get("Content-Type")) ||
+			(hasContentEncoding(req.Header) && !stream.gunzip)
+		built.stream = stream
+		built.release = func() {
+			if !stream.handedOff {
+				stream.src.Close()
+			}
+		}
+		if stream.gunzip {
+			// The inflated length isn't known up front
+			req.Header.Del("Content-Encoding")
+			req.Header.Del("Content-Length")
+		}
+	} else {
+		var err error
+		var spilled *spillFile
+		var head []byte
+		if rt.spillBodyBytes > 0 && req.Body != nil && req.Body != http.NoBody {
+			spilled, head, err = rt.spillBody(req)
+		}
+		if spilled != nil {
+			// eventReader closes the file too once the event has been sent
+			built.release = func() { spilled.Close() }
+			stream := &streamedBody{
+				src:         spilled,
+				placeholder: newBodyPlaceholder(),
+				gunzip:      rt.decompressRequest && strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip"),
+			}
+			// The file was checked for valid UTF-8 as it was written; an
+			// inflated body can only be checked once it's streamed
+			stream.base64 = !rt.isTextContentType(sniffContentType(req.Header.Get("Content-Type"), head)) ||
+				(hasContentEncoding(req.Header) && !stream.gunzip) ||
+				(!stream.gunzip && !spilled.validUTF8)
+			built.stream = stream
+			if stream.gunzip {
+				req.Header.Del("Content-Encoding")
+				req.Header.Del("Content-Length")
+			}
+		} else if err == nil {
+			built.body, err = rt.readBody(req)
+		}
+		if err != nil {
+			var mismatch *lengthMismatchError
+			switch {
+			case req.Context().Err() != nil:
+				// A disconnect mid-upload is the client's doing, not a bad body
+				return abort(&transformError{status: statusClientClosedRequest, err: err})
+			case err == errBodyTooLarge:
+				return abort(&transformError{status: http.StatusRequestEntityTooLarge, msg: err.Error(), err: err})
+			case errors.As(err, &mismatch):
+				return abort(&transformError{status: http.StatusBadRequest, msg: mismatch.Error(), err: err})
+			default:
+				return abort(&transformError{status: http.StatusBadRequest, msg: "could not read request body", err: fmt.Errorf("body read: %w", err)})
+			}
+		}
+	}
+	if err := req.Context().Err(); err != nil {
+		return abort(&transformError{status: statusClientClosedRequest, err: err})
+	}
+
+	built.info = rt.newRequestInfo(req, built.body, built.stream, requestID, now)
+	built.info.rawURL = rawURL
+	return built, nil
+}
+
+// sortedJSON re-encodes a JSON document with object keys sorted at every
+// level. encoding/json already sorts map keys, so this only changes objects
+// that arrive pre-encoded: template output and bodyJSON. Numbers keep their
+// original text.
+func sortedJSON(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return marshalJSON(v)
+}
+
+// marshalJSON is json.Marshal without HTML escaping, so values such as
+// rawQueryString keep a literal "&" instead of "\u0026", byte for byte as
+// the client sent them and as API Gateway emits them.
+func marshalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	// Encode terminates the value with a newline
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// templateData is the value an EventTemplate is executed with.
+type templateData struct {
+	Method          string
+	Path            string
+	Query           string
+	QueryParameters map[string]string
+	Headers         map[string]string
+	Body            string
+	IsBase64Encoded bool
+	SourceIP        string
+	RequestID       string
+	Time            time.Time
+}
+
+// templateFuncs are available to event templates.
+var templateFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := marshalJSON(v)
+		return string(b), err
+	},
+}
+
+// sampleTemplateData is what parseEventTemplate test-renders a template
+// with.
+var sampleTemplateData = &templateData{
+	Method:          http.MethodGet,
+	Path:            "/",
+	QueryParameters: map[string]string{},
+	Headers:         map[string]string{},
+	SourceIP:        "127.0.0.1",
+	RequestID:       "00000000-0000-0000-0000-000000000000",
+	Time:            time.Unix(0, 0).UTC(),
+}
+
+// parseEventTemplate compiles an event template and renders it once, so
+// errors surface at startup rather than as a 500 on every request: a
+// misspelled field, or output that isn't JSON such as an unquoted
+// {{.Method}}. Missing map keys are allowed in the trial run, since they
+// depend on the request.
+func parseEventTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("event").Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid eventTemplate: %w", err)
+	}
+	trial, err := tmpl.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("invalid eventTemplate: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := trial.Option("missingkey=zero").Execute(&buf, sampleTemplateData); err != nil {
+		return nil, fmt.Errorf("invalid eventTemplate: %w", err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, fmt.Errorf("invalid eventTemplate: renders invalid JSON for a sample request: %s", buf.Bytes())
+	}
+	return tmpl, nil
+}
+
+// renderEventTemplate executes the event template and checks that the
+// result is valid JSON.
+func (rt *LambdaRequestTransformer) renderEventTemplate(info *requestInfo) ([]byte, error) {
+	data := &templateData{
+		Method:          info.method,
+		Path:            info.path,
+		Query:           info.rawQuery,
+		QueryParameters: singleValueQuery(info.query),
+		Headers:         info.headers,
+		Body:            info.body,
+		IsBase64Encoded: info.isBase64,
+		SourceIP:        info.sourceIP,
+		RequestID:       info.requestID,
+		Time:            info.now,
+	}
+
+	var buf bytes.Buffer
+	if err := rt.eventTemplate.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("eventTemplate did not render valid JSON")
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,362 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// eventFor builds the event for req through the same buildEvent step
+// ServeHTTP uses, and decodes it. A streamed body is spliced in.
+func eventFor(t testing.TB, cfg *Config, req *http.Request, now time.Time, requestID string) map[string]interface{} {
+	t.Helper()
+	rt, err := NewHandler(http.NotFoundHandler(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := rt.buildEvent(req, now.UTC(), requestID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer built.release()
+
+	payload := built.payload
+	if built.stream != nil {
+		r := rt.eventReader(built.payload, built.stream)
+		defer r.Close()
+		if payload, err = io.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		t.Fatalf("event is not JSON: %v\n%s", err, payload)
+	}
+	return event
+}
+
+// fixedTime is the clock used by tests that compare whole events.
+var fixedTime = time.Date(2024, 3, 1, 12, 30, 45, 123e6, time.UTC)
+
+func TestBuildEventMatchesServeHTTP(t *testing.T) {
+	newCfg := func() *Config {
+		cfg := CreateConfig()
+		cfg.InjectHeaders = map[string]string{"X-Env": "prod"}
+		cfg.PromoteQueryToHeader = map[string]string{"tenant": "X-Tenant"}
+		cfg.PromoteHeaderToQuery = map[string]string{"X-Region": "region"}
+		cfg.MaxHeaderCount = 10
+		cfg.SortEventKeys = true
+		cfg.InlineJSONBody = true
+		return cfg
+	}
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "http://api.example.com/orders?tenant=acme", bytes.NewReader([]byte(`{"b":1,"a":2}`)))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Region", "eu-west-1")
+		req.Header.Set("X-Request-Id", "req-1")
+		return req
+	}
+
+	direct := eventFor(t, newCfg(), newReq(), fixedTime, "req-1")
+
+	var raw []byte
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		raw, _ = io.ReadAll(req.Body)
+	})
+	rt, err := NewHandler(next, newCfg())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.nowFunc = func() time.Time { return fixedTime }
+	rt.ServeHTTP(httptest.NewRecorder(), newReq())
+	var served map[string]interface{}
+	if err := json.Unmarshal(raw, &served); err != nil {
+		t.Fatalf("served event is not JSON: %v\n%s", err, raw)
+	}
+
+	if !reflect.DeepEqual(direct, served) {
+		t.Errorf("buildEvent and ServeHTTP disagree:\nbuildEvent: %v\nServeHTTP:  %v", direct, served)
+	}
+
+	// The steps buildEvent used to skip
+	headers := direct["headers"].(map[string]interface{})
+	if headers["x-env"] != "prod" || headers["x-tenant"] != "acme" {
+		t.Errorf("injected or promoted headers missing: %v", headers)
+	}
+	if got := direct["rawQueryString"]; got != "tenant=acme&region=eu-west-1" {
+		t.Errorf("rawQueryString = %v", got)
+	}
+}
+
+func TestBuildEventHeaderLimitError(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxHeaderCount = 1
+	rt, err := NewHandler(http.NotFoundHandler(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-A", "1")
+	req.Header.Set("X-B", "2")
+
+	_, err = rt.buildEvent(req, fixedTime, "req-1")
+	var te *transformError
+	if !errors.As(err, &te) || te.status != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("err = %v, want a 431 transformError", err)
+	}
+	if !errors.Is(err, errHeadersTooLarge) {
+		t.Errorf("err does not wrap errHeadersTooLarge: %v", err)
+	}
+}
+
+func TestBuildEventStreamedBody(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.StreamBody = true
+	req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader([]byte("streamed \"text\"")))
+	req.Header.Set("Content-Type", "text/plain")
+
+	event := eventFor(t, cfg, req, fixedTime, "req-1")
+	if got := event["body"]; got != "streamed \"text\"" {
+		t.Errorf("body = %q", got)
+	}
+}
+
+func TestParseDomain(t *testing.T) {
+	tests := []struct {
+		host, name, prefix string
+	}{
+		{host: "[::1]:8080", name: "::1", prefix: "::1"},
+		{host: "[::1]", name: "::1", prefix: "::1"},
+		{host: "example.com:443", name: "example.com", prefix: "example"},
+		{host: "api.example.com", name: "api.example.com", prefix: "api"},
+		{host: "127.0.0.1:80", name: "127.0.0.1", prefix: "127.0.0.1"},
+		{host: "localhost", name: "localhost", prefix: "localhost"},
+	}
+	for _, tt := range tests {
+		name, prefix := parseDomain(tt.host)
+		if name != tt.name || prefix != tt.prefix {
+			t.Errorf("parseDomain(%q) = (%q, %q), want (%q, %q)", tt.host, name, prefix, tt.name, tt.prefix)
+		}
+	}
+}
+
+func TestTimeEpochFromInjectedClock(t *testing.T) {
+	var raw []byte
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		raw, _ = io.ReadAll(req.Body)
+	})
+	rt, err := NewHandler(next, CreateConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt.nowFunc = func() time.Time { return fixedTime }
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello", nil))
+
+	var event struct {
+		RequestContext struct {
+			TimeEpoch json.RawMessage `json:"timeEpoch"`
+		} `json:"requestContext"`
+	}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		t.Fatal(err)
+	}
+	// Epoch milliseconds as a JSON number, as API Gateway sends it
+	if got := string(event.RequestContext.TimeEpoch); got != "1709296245123" {
+		t.Errorf("timeEpoch = %s, want 1709296245123", got)
+	}
+}
+
+func TestRawQueryStringIsByteForByte(t *testing.T) {
+	rt, err := NewHandler(http.NotFoundHandler(), CreateConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, query := range []string{"a=b+c", "a=%2F", "a=&b=", "a=b%20c&a=d", "q=%E2%9C%93&x=<y>"} {
+		req := httptest.NewRequest(http.MethodGet, "/search?"+query, nil)
+		built, err := rt.buildEvent(req, fixedTime, "req-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		built.release()
+
+		// Compare the encoded bytes: decoding would hide \u0026-style escapes
+		want := []byte(`"rawQueryString":"` + query + `"`)
+		if !bytes.Contains(built.payload, want) {
+			t.Errorf("query %q: payload lacks %s\n%s", query, want, built.payload)
+		}
+	}
+}
+
+func TestEmptyHostFallsBackToDomainName(t *testing.T) {
+	tests := []struct {
+		fallback, wantName, wantPrefix string
+	}{
+		{fallback: "", wantName: defaultFallbackDomainName, wantPrefix: defaultFallbackDomainName},
+		{fallback: "api.internal.example", wantName: "api.internal.example", wantPrefix: "api"},
+	}
+	for _, tt := range tests {
+		cfg := CreateConfig()
+		cfg.FallbackDomainName = tt.fallback
+		// An HTTP/1.0 request without a Host header
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+		req.Host = ""
+		event := eventFor(t, cfg, req, fixedTime, "req-1")
+
+		reqCtx := event["requestContext"].(map[string]interface{})
+		if reqCtx["domainName"] != tt.wantName || reqCtx["domainPrefix"] != tt.wantPrefix {
+			t.Errorf("fallback %q: domainName = %v, domainPrefix = %v, want %s and %s",
+				tt.fallback, reqCtx["domainName"], reqCtx["domainPrefix"], tt.wantName, tt.wantPrefix)
+		}
+	}
+}
+
+func TestSortedEventIsByteStable(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.SortEventKeys = true
+	cfg.InlineJSONBody = true
+	cfg.PromoteHeaderToQuery = map[string]string{"X-A": "a", "X-B": "b", "X-C": "c", "X-D": "d"}
+	rt, err := NewHandler(http.NotFoundHandler(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var first []byte
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/sign?z=1", bytes.NewReader([]byte(`{"z":1,"a":{"y":2,"b":3}}`)))
+		req.Header.Set("Content-Type", "application/json")
+		for h := range cfg.PromoteHeaderToQuery {
+			req.Header.Set(h, "v")
+		}
+		built, err := rt.buildEvent(req, fixedTime, "req-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		built.release()
+		if first == nil {
+			first = built.payload
+		} else if !bytes.Equal(built.payload, first) {
+			t.Fatalf("run %d differs:\n%s\n%s", i, built.payload, first)
+		}
+	}
+}
+
+// BenchmarkEventEncoding compares the sortEventKeys re-encode with plain
+// json.Marshal of the same event.
+func BenchmarkEventEncoding(b *testing.B) {
+	cfg := CreateConfig()
+	cfg.InlineJSONBody = true
+	rt, err := NewHandler(http.NotFoundHandler(), cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/orders?page=2&sort=desc",
+		bytes.NewReader([]byte(`{"items":[{"sku":"a-1","qty":2},{"sku":"b-7","qty":1}],"customer":{"id":42,"tier":"gold"}}`)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "bench/1.0")
+	req.Header.Set("Accept", "application/json")
+	// The map step of the real pipeline, before anything is encoded
+	built, err := rt.prepareEvent(req, fixedTime, "req-1")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer built.release()
+	event := rt.eventMap(built.info, built.body, "application/json")
+	payload, err := marshalJSON(event)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("json.Marshal", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := json.Marshal(event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("marshalJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := marshalJSON(event); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("marshalJSON+sortedJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			data, err := marshalJSON(event)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := sortedJSON(data); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("sortedJSON", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(payload)))
+		for i := 0; i < b.N; i++ {
+			if _, err := sortedJSON(payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRawRequestURLExcludesPromotedParameters(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.IncludeRawRequestURL = true
+	cfg.PromoteHeaderToQuery = map[string]string{"X-Api-Key": "api_key"}
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/x?a=1", nil)
+	req.Header.Set("X-Api-Key", "secret")
+	event := eventFor(t, cfg, req, fixedTime, "req-1")
+
+	reqCtx := event["requestContext"].(map[string]interface{})
+	if got := reqCtx["rawRequestURL"]; got != "http://api.example.com/x?a=1" {
+		t.Errorf("rawRequestURL = %v, want the URL as sent", got)
+	}
+	// The promotion itself still happens
+	if got := event["rawQueryString"]; got != "a=1&api_key=secret" {
+		t.Errorf("rawQueryString = %v", got)
+	}
+}
+
+func TestPrepareEventMapIsWhatBuildEventEncodes(t *testing.T) {
+	rt, err := NewHandler(http.NotFoundHandler(), CreateConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/orders?x=1", bytes.NewReader([]byte(`{"a":1}`)))
+		req.Header.Set("Content-Type", "application/json")
+		return req
+	}
+
+	prepared, err := rt.prepareEvent(newReq(), fixedTime, "req-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepared.release()
+	fromMap, err := marshalJSON(rt.eventMap(prepared.info, prepared.body, "application/json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := rt.buildEvent(newReq(), fixedTime, "req-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	built.release()
+	if !bytes.Equal(fromMap, built.payload) {
+		t.Errorf("eventMap and buildEvent differ:\n%s\n%s", fromMap, built.payload)
+	}
+}
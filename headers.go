@@ -0,0 +1,116 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+	"strings"
+)
+
+// canonicalSet builds a lookup set of canonical header names.
+func canonicalSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		return nil
+	}
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[http.CanonicalHeaderKey(n)] = true
+	}
+	return set
+}
+
+// canonicalKeys copies m with its keys in canonical header form.
+func canonicalKeys(m map[string]string) map[string]string {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(m))
+	for k, v := range m {
+		out[http.CanonicalHeaderKey(k)] = v
+	}
+	return out
+}
+
+// injectHeaders adds the configured InjectHeaders to the request, so they
+// reach both the event and the upstream. Headers the client sent are only
+// replaced with OverwriteInjectedHeaders.
+func (rt *LambdaRequestTransformer) injectHeaders(req *http.Request) {
+	for h, v := range rt.injectedHeaders {
+		if rt.overwriteInjected || len(req.Header[h]) == 0 {
+			req.Header.Set(h, v)
+		}
+	}
+}
+
+// headerKey renders a canonical header name in the configured key casing.
+func (rt *LambdaRequestTransformer) headerKey(name string) string {
+	if rt.headerKeyCase == headerCaseLower {
+		return strings.ToLower(name)
+	}
+	return name
+}
+
+// eventHeader returns the subset of the request headers that is copied into
+// the event. With no allowlist configured every header is kept; the
+// denylist and prefix filters are applied after it and always win.
+func (rt *LambdaRequestTransformer) eventHeader(req *http.Request) http.Header {
+	out := make(http.Header, len(req.Header)+1)
+	for h, values := range req.Header {
+		if rt.keepHeader(h) {
+			out[h] = values
+		}
+	}
+	// net/http moves Host out of req.Header, but API Gateway events carry
+	// it. StripHostHeader has to be honored here too: req.Header alone
+	// almost never holds a Host to strip.
+	if !rt.stripHost && req.Host != "" && out["Host"] == nil && rt.keepHeader("Host") {
+		out["Host"] = []string{req.Host}
+	}
+	return out
+}
+
+// keepHeader reports whether the canonical header name passes the
+// allowlist, denylist and prefix filters.
+func (rt *LambdaRequestTransformer) keepHeader(h string) bool {
+	if rt.forwardHeaders != nil && !rt.forwardHeaders[h] {
+		return false
+	}
+	if rt.stripHeaders[h] || rt.hasStrippedPrefix(h) {
+		return false
+	}
+	return !(rt.stripHost && h == "Host")
+}
+
+// hasStrippedPrefix reports whether the canonical header name starts with
+// one of the StripHeaderPrefixes.
+func (rt *LambdaRequestTransformer) hasStrippedPrefix(name string) bool {
+	lower := strings.ToLower(name)
+	for _, p := range rt.stripHeaderPrefixes {
+		if strings.HasPrefix(lower, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// headersWithinLimits reports whether the request headers respect the
+// configured count and size limits.
+func (rt *LambdaRequestTransformer) headersWithinLimits(header http.Header) bool {
+	if rt.maxHeaderCount == 0 && rt.maxHeaderBytes == 0 {
+		return true
+	}
+
+	count, size := 0, 0
+	for h, values := range header {
+		count += len(values)
+		size += len(h)
+		for i, v := range values {
+			if i > 0 {
+				size++ // joining comma
+			}
+			size += len(v)
+		}
+	}
+	if rt.maxHeaderCount > 0 && count > rt.maxHeaderCount {
+		return false
+	}
+	return rt.maxHeaderBytes == 0 || size <= rt.maxHeaderBytes
+}
@@ -0,0 +1,138 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHeaderLimitsIgnoreInjectedHeaders(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxHeaderCount = 2
+	cfg.InjectHeaders = map[string]string{"X-Env": "prod", "X-Team": "payments", "X-Region": "eu"}
+	cfg.PromoteQueryToHeader = map[string]string{"tenant": "X-Tenant"}
+
+	var called bool
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) { called = true })
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/hello?tenant=acme", nil)
+	req.Header.Set("Accept", "*/*")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code == http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatal("injected and promoted headers counted against maxHeaderCount")
+	}
+	if !called {
+		t.Fatalf("next not called, status %d", rec.Code)
+	}
+}
+
+func TestHeaderLimitsRejectClientHeaders(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.MaxHeaderCount = 2
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		t.Error("next called for an oversized header set")
+	})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+	req.Header.Add("X-A", "1")
+	req.Header.Add("X-B", "2")
+	req.Header.Add("X-C", "3")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("status = %d, want 431", rec.Code)
+	}
+}
+
+func TestStripHostHeader(t *testing.T) {
+	for _, version := range []string{payloadVersion1, payloadVersion2} {
+		for _, strip := range []bool{false, true} {
+			cfg := CreateConfig()
+			cfg.PayloadVersion = version
+			cfg.StripHostHeader = strip
+
+			req := httptest.NewRequest(http.MethodGet, "http://api.example.com/hello", nil)
+			event := captureEvent(t, cfg, req)
+
+			headers, _ := event["headers"].(map[string]interface{})
+			_, hasHost := headers["Host"]
+			if !hasHost {
+				_, hasHost = headers["host"]
+			}
+			if hasHost == strip {
+				t.Errorf("%s strip=%t: headers = %v", version, strip, headers)
+			}
+			if multi, ok := event["multiValueHeaders"].(map[string]interface{}); ok {
+				if _, hasHost := multi["Host"]; hasHost == strip {
+					t.Errorf("%s strip=%t: multiValueHeaders = %v", version, strip, multi)
+				}
+			}
+
+			// The host is still reported where handlers should look for it
+			reqCtx := event["requestContext"].(map[string]interface{})
+			if reqCtx["domainName"] != "api.example.com" {
+				t.Errorf("%s strip=%t: domainName = %v", version, strip, reqCtx["domainName"])
+			}
+		}
+	}
+}
+
+func TestV2HeadersAreLowercase(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/hello", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	event := eventFor(t, CreateConfig(), req, fixedTime, "req-1")
+
+	headers := event["headers"].(map[string]interface{})
+	if got := headers["content-type"]; got != "application/json" {
+		t.Errorf(`headers["content-type"] = %v, want application/json`, got)
+	}
+	if _, ok := headers["Content-Type"]; ok {
+		t.Error("2.0 event carries canonical Content-Type")
+	}
+}
+
+func TestV1MultiValueHeadersStayCanonical(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.PayloadVersion = payloadVersion1
+	req := httptest.NewRequest(http.MethodPost, "/hello", strings.NewReader(`{}`))
+	req.Header.Set("Content-Type", "application/json")
+	event := eventFor(t, cfg, req, fixedTime, "req-1")
+
+	multi := event["multiValueHeaders"].(map[string]interface{})
+	if _, ok := multi["Content-Type"]; !ok {
+		t.Errorf("multiValueHeaders = %v, want canonical Content-Type", multi)
+	}
+}
+
+func TestHostHeaderIsInEvent(t *testing.T) {
+	tests := []struct {
+		version, key string
+	}{
+		{version: payloadVersion2, key: "host"},
+		{version: payloadVersion1, key: "Host"},
+	}
+	for _, tt := range tests {
+		cfg := CreateConfig()
+		cfg.PayloadVersion = tt.version
+		event := eventFor(t, cfg, httptest.NewRequest(http.MethodGet, "http://api.example.com:8443/hello", nil), fixedTime, "req-1")
+
+		headers := event["headers"].(map[string]interface{})
+		if got := headers[tt.key]; got != "api.example.com:8443" {
+			t.Errorf("%s: headers[%q] = %v, want api.example.com:8443", tt.version, tt.key, got)
+		}
+	}
+}
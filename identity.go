@@ -0,0 +1,72 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// identitySource is a parsed IdentitySources expression.
+type identitySource struct {
+	kind string // "header", "querystring" or "stageVariables"
+	name string
+}
+
+// Identity source expression prefixes, as API Gateway spells them.
+const (
+	identityHeaderPrefix = "$request.header."
+	identityQueryPrefix  = "$request.querystring."
+	identityStagePrefix  = "$stageVariables."
+)
+
+// parseIdentitySources validates IdentitySources expressions so mistakes
+// surface at startup.
+func parseIdentitySources(exprs []string) ([]identitySource, error) {
+	sources := make([]identitySource, 0, len(exprs))
+	for _, expr := range exprs {
+		expr = strings.TrimSpace(expr)
+		var src identitySource
+		switch {
+		case strings.HasPrefix(expr, identityHeaderPrefix):
+			src = identitySource{kind: "header", name: http.CanonicalHeaderKey(expr[len(identityHeaderPrefix):])}
+		case strings.HasPrefix(expr, identityQueryPrefix):
+			src = identitySource{kind: "querystring", name: expr[len(identityQueryPrefix):]}
+		case strings.HasPrefix(expr, identityStagePrefix):
+			src = identitySource{kind: "stageVariables", name: expr[len(identityStagePrefix):]}
+		}
+		if src.name == "" {
+			return nil, fmt.Errorf("unsupported identity source %q: must be $request.header.<name>, $request.querystring.<name> or $stageVariables.<name>", expr)
+		}
+		sources = append(sources, src)
+	}
+	return sources, nil
+}
+
+// identitySourceValues resolves the configured identity sources against the
+// request, in order. Missing or empty sources contribute nothing. Without
+// IdentitySources, the x-session-id header is used.
+func (rt *LambdaRequestTransformer) identitySourceValues(req *http.Request, query url.Values) []string {
+	values := []string{}
+	if rt.identitySources == nil {
+		if v := req.Header.Get("x-session-id"); v != "" {
+			values = append(values, v)
+		}
+		return values
+	}
+	for _, src := range rt.identitySources {
+		var v string
+		switch src.kind {
+		case "header":
+			v = req.Header.Get(src.name)
+		case "querystring":
+			v = query.Get(src.name)
+		case "stageVariables":
+			v = rt.stageVariables[src.name]
+		}
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,58 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Supported event key styles.
+const (
+	keyStyleCamel = "camel"
+	keyStyleSnake = "snake"
+)
+
+// opaqueEventKeys hold client data (JWT claims) whose keys are never renamed.
+// Other data maps (headers, query and path parameters, stage variables,
+// authorizer context) are map[string]string and are left alone by type.
+var opaqueEventKeys = map[string]bool{
+	"claims": true,
+}
+
+// snakeCaseKeys renames the keys of event and every nested event object
+// from camelCase to snake_case in place.
+func snakeCaseKeys(event map[string]interface{}) {
+	keys := make([]string, 0, len(event))
+	for k := range event {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		v := event[k]
+		if nested, ok := v.(map[string]interface{}); ok && !opaqueEventKeys[k] {
+			snakeCaseKeys(nested)
+		}
+		if snake := toSnakeCase(k); snake != k {
+			delete(event, k)
+			event[snake] = v
+		}
+	}
+}
+
+// toSnakeCase converts a camelCase key to snake_case, keeping acronym runs
+// together: "rawQueryString" becomes "raw_query_string" and "subjectDN"
+// becomes "subject_dn".
+func toSnakeCase(s string) string {
+	runes := []rune(s)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) {
+			prevLower := i > 0 && (unicode.IsLower(runes[i-1]) || unicode.IsDigit(runes[i-1]))
+			acronymEnd := i > 0 && unicode.IsUpper(runes[i-1]) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if prevLower || acronymEnd {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,89 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// Metric names, as served at MetricsPath.
+const (
+	metricRequests     = "lambda_transform_requests_total"
+	metricErrors       = "lambda_transform_errors_total"
+	metricPayloadBytes = "lambda_transform_payload_bytes"
+)
+
+// payloadBuckets are the upper bounds (in bytes) of the payload size
+// histogram, Prometheus-style with a trailing +Inf bucket.
+var payloadBuckets = []int64{1 << 10, 16 << 10, 256 << 10, 1 << 20, 6 << 20}
+
+// metrics holds the process-wide counters shared by every plugin instance.
+// It deliberately avoids expvar: importing it publishes /debug/vars on
+// http.DefaultServeMux, including the process command line and memstats.
+type metrics struct {
+	requests int64
+	errors   int64
+	// buckets holds one counter per payloadBuckets entry, then +Inf
+	buckets []int64
+	sum     int64
+	count   int64
+}
+
+var (
+	metricsOnce sync.Once
+	sharedStats *metrics
+)
+
+// RegisterMetrics sets up the transformer's shared counters. It is safe to
+// call repeatedly; they are only created the first time.
+func RegisterMetrics() {
+	metricsOnce.Do(func() {
+		sharedStats = &metrics{buckets: make([]int64, len(payloadBuckets)+1)}
+	})
+}
+
+// observe records one transformed request with the given payload size.
+// It is a no-op on a nil receiver so disabled metrics cost nothing.
+func (m *metrics) observe(size int) {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.requests, 1)
+	// Buckets are cumulative, as in Prometheus histograms
+	for i, b := range payloadBuckets {
+		if int64(size) <= b {
+			atomic.AddInt64(&m.buckets[i], 1)
+		}
+	}
+	atomic.AddInt64(&m.buckets[len(payloadBuckets)], 1)
+	atomic.AddInt64(&m.sum, int64(size))
+	atomic.AddInt64(&m.count, 1)
+}
+
+// failed records one transformation error. It is a no-op on a nil receiver.
+func (m *metrics) failed() {
+	if m == nil {
+		return
+	}
+	atomic.AddInt64(&m.errors, 1)
+}
+
+// ServeHTTP writes the counters, and nothing else, as a JSON object.
+func (m *metrics) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+	histogram := make(map[string]int64, len(m.buckets)+2)
+	for i, b := range payloadBuckets {
+		histogram["le_"+strconv.FormatInt(b, 10)] = atomic.LoadInt64(&m.buckets[i])
+	}
+	histogram["le_inf"] = atomic.LoadInt64(&m.buckets[len(payloadBuckets)])
+	histogram["sum"] = atomic.LoadInt64(&m.sum)
+	histogram["count"] = atomic.LoadInt64(&m.count)
+
+	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+		metricRequests:     atomic.LoadInt64(&m.requests),
+		metricErrors:       atomic.LoadInt64(&m.errors),
+		metricPayloadBytes: histogram,
+	})
+}
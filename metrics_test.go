@@ -0,0 +1,57 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMetricsPathServesOnlyTransformerCounters(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.Metrics = true
+	cfg.MetricsPath = "/_lambda/metrics"
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// One transformed request so the counters move
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/hello", nil))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_lambda/metrics", nil))
+
+	var vars map[string]json.RawMessage
+	if err := json.Unmarshal(rec.Body.Bytes(), &vars); err != nil {
+		t.Fatalf("metrics body is not JSON: %v\n%s", err, rec.Body.String())
+	}
+	if len(vars) != 3 {
+		t.Errorf("got %d vars, want 3: %s", len(vars), rec.Body.String())
+	}
+	for _, name := range []string{metricRequests, metricErrors, metricPayloadBytes} {
+		if _, ok := vars[name]; !ok {
+			t.Errorf("missing %s", name)
+		}
+	}
+	for _, leaked := range []string{"cmdline", "memstats"} {
+		if _, ok := vars[leaked]; ok {
+			t.Errorf("metrics path exposes %s", leaked)
+		}
+	}
+
+	var requests int64
+	if err := json.Unmarshal(vars[metricRequests], &requests); err != nil || requests < 1 {
+		t.Errorf("%s = %s, want >= 1", metricRequests, vars[metricRequests])
+	}
+}
+
+func TestMetricsDoNotTouchDefaultServeMux(t *testing.T) {
+	RegisterMetrics()
+	if _, pattern := http.DefaultServeMux.Handler(httptest.NewRequest(http.MethodGet, "/debug/vars", nil)); pattern != "" {
+		t.Errorf("/debug/vars is registered on DefaultServeMux as %q", pattern)
+	}
+}
@@ -0,0 +1,68 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+)
+
+// Option adjusts the configuration used by NewWithOptions.
+type Option func(*Config)
+
+// NewWithOptions builds the transformer from CreateConfig's defaults with
+// opts applied in order.
+func NewWithOptions(next http.Handler, opts ...Option) (*LambdaRequestTransformer, error) {
+	config := CreateConfig()
+	for _, opt := range opts {
+		opt(config)
+	}
+	return NewHandler(next, config)
+}
+
+// WithStage sets requestContext.stage.
+func WithStage(stage string) Option {
+	return func(c *Config) { c.Stage = stage }
+}
+
+// WithAccountID sets requestContext.accountId.
+func WithAccountID(accountID string) Option {
+	return func(c *Config) { c.AccountID = accountID }
+}
+
+// WithAPIID sets requestContext.apiId.
+func WithAPIID(apiID string) Option {
+	return func(c *Config) { c.APIID = apiID }
+}
+
+// WithEventFormat selects "apigateway", "alb" or "functionurl" events.
+func WithEventFormat(format string) Option {
+	return func(c *Config) { c.EventFormat = format }
+}
+
+// WithPayloadVersion selects the "1.0" or "2.0" API Gateway payload.
+func WithPayloadVersion(version string) Option {
+	return func(c *Config) { c.PayloadVersion = version }
+}
+
+// WithForwardHeaders sets the allowlist of headers copied into the event.
+func WithForwardHeaders(headers []string) Option {
+	return func(c *Config) { c.ForwardHeaders = headers }
+}
+
+// WithStripHeaders sets the headers removed from the event.
+func WithStripHeaders(headers []string) Option {
+	return func(c *Config) { c.StripHeaders = headers }
+}
+
+// WithTransformResponse enables unwrapping the Lambda proxy response.
+func WithTransformResponse(enabled bool) Option {
+	return func(c *Config) { c.TransformResponse = enabled }
+}
+
+// WithMaxBodyBytes sets the request body limit; zero means unlimited.
+func WithMaxBodyBytes(n int64) Option {
+	return func(c *Config) { c.MaxBodyBytes = n }
+}
+
+// WithInvokePath sets the path the rewritten request is sent to.
+func WithInvokePath(path string) Option {
+	return func(c *Config) { c.InvokePath = path }
+}
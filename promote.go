@@ -0,0 +1,60 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// promotion copies the value named from to the name to.
+type promotion struct {
+	from, to string
+}
+
+// sortedPromotions flattens a promotion map in source-name order. Map
+// iteration order is random, and it decides both which of two sources
+// targeting the same name wins and the order of appended query parameters.
+func sortedPromotions(m map[string]string) []promotion {
+	if len(m) == 0 {
+		return nil
+	}
+	out := make([]promotion, 0, len(m))
+	for from, to := range m {
+		out = append(out, promotion{from: from, to: to})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].from < out[j].from })
+	return out
+}
+
+// promote copies values between the query string and headers as configured
+// by PromoteQueryToHeader and PromoteHeaderToQuery, before the event is
+// built. Missing sources are no-ops and values already present at the
+// destination are kept. Added parameters are appended to the raw query so
+// the client's own bytes are left as they were.
+func (rt *LambdaRequestTransformer) promote(req *http.Request) {
+	if len(rt.promoteQueryToHeader) == 0 && len(rt.promoteHeaderToQuery) == 0 {
+		return
+	}
+
+	query := req.URL.Query()
+	for _, p := range rt.promoteQueryToHeader {
+		param, header := p.from, p.to
+		if v := query.Get(param); v != "" && req.Header.Get(header) == "" {
+			req.Header.Set(header, v)
+		}
+	}
+	for _, p := range rt.promoteHeaderToQuery {
+		header, param := p.from, p.to
+		v := req.Header.Get(header)
+		if v == "" || query.Has(param) {
+			continue
+		}
+		pair := url.QueryEscape(param) + "=" + url.QueryEscape(v)
+		if req.URL.RawQuery == "" {
+			req.URL.RawQuery = pair
+		} else {
+			req.URL.RawQuery += "&" + pair
+		}
+		query.Set(param, v)
+	}
+}
@@ -0,0 +1,39 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPromoteHeaderToQueryIsDeterministic(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.PromoteHeaderToQuery = map[string]string{
+		"X-Tenant": "tenant", "X-Region": "region", "X-Env": "env",
+		"X-App": "app", "X-Zone": "zone", "X-User": "user",
+	}
+
+	// Map order is randomized per range, so a few rounds would catch it
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/hello?q=1", nil)
+		for h := range cfg.PromoteHeaderToQuery {
+			req.Header.Set(h, "v")
+		}
+		event := captureEvent(t, cfg, req)
+		if got, want := event["rawQueryString"], "q=1&app=v&env=v&region=v&tenant=v&user=v&zone=v"; got != want {
+			t.Fatalf("rawQueryString = %v, want %s", got, want)
+		}
+	}
+}
+
+func TestPromoteQueryToHeaderSameTargetFirstSourceWins(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.PromoteQueryToHeader = map[string]string{"b": "X-Tenant", "a": "X-Tenant"}
+	for i := 0; i < 20; i++ {
+		event := captureEvent(t, cfg, httptest.NewRequest(http.MethodGet, "/hello?a=first&b=second", nil))
+		headers := event["headers"].(map[string]interface{})
+		if got := headers["x-tenant"]; got != "first" {
+			t.Fatalf("X-Tenant = %v, want first", got)
+		}
+	}
+}
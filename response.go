@@ -0,0 +1,303 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// lambdaResponse is a Lambda proxy integration response.
+type lambdaResponse struct {
+	StatusCode        int                 `json:"statusCode"`
+	Headers           map[string]string   `json:"headers"`
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	Cookies           []string            `json:"cookies"`
+	Body              string              `json:"body"`
+	IsBase64Encoded   bool                `json:"isBase64Encoded"`
+}
+
+// responseRecorder buffers the upstream response so it can be unwrapped
+// before anything reaches the client.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+
+	// limit caps the buffered body; zero means unlimited
+	limit    int64
+	tooLarge bool
+}
+
+// errResponseTooLarge is returned by responseRecorder.Write past the limit.
+var errResponseTooLarge = errors.New("upstream response exceeds maxResponseBytes")
+
+func newResponseRecorder(limit int64) *responseRecorder {
+	return &responseRecorder{header: make(http.Header), limit: limit}
+}
+
+// Header implements http.ResponseWriter.
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// Write implements http.ResponseWriter.
+func (r *responseRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	// Failing the write makes the upstream stop sending
+	if r.limit > 0 && int64(r.body.Len()+len(p)) > r.limit {
+		r.tooLarge = true
+		return 0, errResponseTooLarge
+	}
+	return r.body.Write(p)
+}
+
+// trailerWriter drops Content-Length before the header is written: net/http
+// only sends trailers on chunked responses.
+type trailerWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+// WriteHeader implements http.ResponseWriter.
+func (w *trailerWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.Header().Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write implements http.ResponseWriter.
+func (w *trailerWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush implements http.Flusher so streaming upstream responses still flush.
+func (w *trailerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *trailerWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeLambdaResponse decodes the buffered Lambda proxy response and writes
+// it to the client as a regular HTTP response. Non-2xx upstream responses
+// (e.g. runtime errors) are relayed unchanged. For HEAD requests only the
+// status and headers are sent.
+func (rt *LambdaRequestTransformer) writeLambdaResponse(rw http.ResponseWriter, req *http.Request, rec *responseRecorder, head bool) {
+	if rec.tooLarge {
+		rt.fail(rw, req, http.StatusBadGateway, "Lambda response too large",
+			fmt.Errorf("%w (%d)", errResponseTooLarge, rec.limit))
+		return
+	}
+
+	upstreamStatus := rec.status
+	if upstreamStatus == 0 {
+		upstreamStatus = http.StatusOK
+	}
+	if upstreamStatus < 200 || upstreamStatus > 299 {
+		copyHeader(rw.Header(), rec.header)
+		rw.WriteHeader(upstreamStatus)
+		if !head {
+			_, _ = rw.Write(rec.body.Bytes())
+		}
+		return
+	}
+
+	// The runtime flags a function that threw; its payload is the error
+	// envelope, not a response. API Gateway answers these with an error too.
+	if kind := rec.header.Get(functionErrorHeader); kind != "" {
+		rt.malformedResponse(rw, req, rec, "Lambda function error", fmt.Errorf("function error (%s)", kind))
+		return
+	}
+
+	status, header, body, err := ParseLambdaResponse(bytes.NewReader(rec.body.Bytes()))
+	if err != nil {
+		msg := "invalid Lambda response"
+		if errors.Is(err, errInvalidBase64Body) {
+			msg = "invalid Lambda response: body is not valid base64"
+		}
+		rt.malformedResponse(rw, req, rec, msg, err)
+		return
+	}
+	if rt.validateResponse && !hasStatusCode(rec.body.Bytes()) {
+		rt.malformedResponse(rw, req, rec, "upstream response is not a Lambda proxy response (no statusCode field); "+
+			"check that this middleware forwards to a Lambda runtime invoke endpoint", errors.New("upstream response has no statusCode"))
+		return
+	}
+	for k, values := range header {
+		rw.Header()[k] = values
+	}
+
+	// Headers (including Location for redirects) are in place; the status
+	// must go out before any body bytes
+	if !bodyAllowed(status) {
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(status)
+		return
+	}
+	// HEAD still reports the length a GET would have returned
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(status)
+	if head {
+		return
+	}
+	_, _ = rw.Write(body)
+}
+
+// maxLoggedResponseBytes bounds how much of a malformed upstream response
+// is logged.
+const maxLoggedResponseBytes = 512
+
+// malformedResponse handles an upstream body that isn't a usable Lambda
+// proxy response, e.g. a crash's stack trace. The start of the body is
+// logged; the client gets FallbackStatus/FallbackBody when configured, else
+// a 502 JSON error.
+func (rt *LambdaRequestTransformer) malformedResponse(rw http.ResponseWriter, req *http.Request, rec *responseRecorder, msg string, err error) {
+	raw := rec.body.Bytes()
+	truncated := len(raw) > maxLoggedResponseBytes
+	if truncated {
+		raw = raw[:maxLoggedResponseBytes]
+	}
+	method, path := clientMethodPath(req)
+	rt.logger.Printf("name=%s method=%s path=%q upstreamBody=%q truncated=%t", rt.name, method, path, raw, truncated)
+
+	if rt.fallbackStatus == 0 && rt.fallbackBody == "" {
+		rt.fail(rw, req, http.StatusBadGateway, msg, err)
+		return
+	}
+
+	status := rt.fallbackStatus
+	if status == 0 {
+		status = http.StatusBadGateway
+	}
+	rt.report(req, status, err)
+	rw.Header().Set("Content-Type", http.DetectContentType([]byte(rt.fallbackBody)))
+	rw.Header().Set("Content-Length", strconv.Itoa(len(rt.fallbackBody)))
+	rw.WriteHeader(status)
+	_, _ = io.WriteString(rw, rt.fallbackBody)
+}
+
+// functionErrorHeader is set by the Lambda runtime API when the function
+// returned an error ("Unhandled" or "Handled").
+const functionErrorHeader = "X-Amz-Function-Error"
+
+// errInvalidBase64Body is wrapped by ParseLambdaResponse when a body flagged
+// isBase64Encoded doesn't decode.
+var errInvalidBase64Body = errors.New("body is not valid base64")
+
+// ParseLambdaResponse decodes a Lambda proxy integration response, the JSON
+// object a function returns to API Gateway:
+//
+//	{
+//	  "statusCode": 200,
+//	  "headers": {"Content-Type": "text/plain"},
+//	  "multiValueHeaders": {"X-Tag": ["a", "b"]},
+//	  "cookies": ["session=abc; HttpOnly"],
+//	  "body": "hello",
+//	  "isBase64Encoded": false
+//	}
+//
+// Like API Gateway's 2.0 format, a JSON payload without a statusCode key
+// (e.g. a bare object, or the runtime's {"errorMessage", "errorType"}
+// envelope) is not unwrapped: it becomes the body of a 200 response with
+// Content-Type application/json. Otherwise every field is optional and
+// statusCode must be in 200-999, since a final response can't be
+// informational (1xx). multiValueHeaders entries replace headers entries of the same name, and
+// each cookie becomes its own Set-Cookie header. The body is base64-decoded
+// when isBase64Encoded is true.
+func ParseLambdaResponse(r io.Reader) (status int, headers http.Header, body []byte, err error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("reading Lambda response: %w", err)
+	}
+	if !hasStatusCode(data) {
+		if !json.Valid(data) {
+			return 0, nil, nil, errors.New("invalid Lambda response: not JSON")
+		}
+		headers = http.Header{"Content-Type": {"application/json"}}
+		return http.StatusOK, headers, data, nil
+	}
+	var resp lambdaResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return 0, nil, nil, fmt.Errorf("invalid Lambda response: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 999 {
+		return 0, nil, nil, fmt.Errorf("invalid Lambda response: statusCode %d", resp.StatusCode)
+	}
+
+	body = []byte(resp.Body)
+	if resp.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(resp.Body)
+		if err != nil {
+			return 0, nil, nil, fmt.Errorf("decoding base64 Lambda response body: %w: %v", errInvalidBase64Body, err)
+		}
+		body = decoded
+	}
+
+	headers = make(http.Header, len(resp.Headers)+len(resp.MultiValueHeaders)+1)
+	for k, v := range resp.Headers {
+		headers.Set(k, v)
+	}
+	for k, values := range resp.MultiValueHeaders {
+		headers.Del(k)
+		for _, v := range values {
+			headers.Add(k, v)
+		}
+	}
+	// Each cookie needs its own Set-Cookie header; clients reject joined values
+	for _, c := range resp.Cookies {
+		headers.Add("Set-Cookie", c)
+	}
+	return resp.StatusCode, headers, body, nil
+}
+
+// bodyAllowed reports whether a response with the given status may carry a
+// body (RFC 9110: not for 1xx, 204 or 304).
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// hasStatusCode reports whether data is a JSON object with a statusCode key.
+func hasStatusCode(data []byte) bool {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return false
+	}
+	_, ok := fields["statusCode"]
+	return ok
+}
+
+// copyHeader adds every value of src to dst.
+func copyHeader(dst, src http.Header) {
+	for k, values := range src {
+		for _, v := range values {
+			dst.Add(k, v)
+		}
+	}
+}
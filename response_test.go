@@ -0,0 +1,217 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// serveLambdaResponse runs a request through a transformResponse handler
+// whose upstream answers with the given Lambda proxy response.
+func serveLambdaResponse(t *testing.T, method, lambdaResponse string) *httptest.ResponseRecorder {
+	t.Helper()
+	cfg := CreateConfig()
+	cfg.TransformResponse = true
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte(lambdaResponse))
+	})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, "/resource", nil))
+	return rec
+}
+
+func TestParseLambdaResponseStatusCodes(t *testing.T) {
+	tests := []struct {
+		response string
+		want     int
+		wantErr  bool
+	}{
+		{response: `{}`, want: http.StatusOK},
+		{response: `{"statusCode":204}`, want: http.StatusNoContent},
+		{response: `{"statusCode":999}`, want: 999},
+		{response: `{"statusCode":100}`, wantErr: true},
+		{response: `{"statusCode":101}`, wantErr: true},
+		{response: `{"statusCode":199}`, wantErr: true},
+		{response: `{"statusCode":-1}`, wantErr: true},
+		{response: `{"statusCode":1000}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		status, _, _, err := ParseLambdaResponse(strings.NewReader(tt.response))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: got status %d, want an error", tt.response, status)
+			}
+			continue
+		}
+		if err != nil || status != tt.want {
+			t.Errorf("%s: got (%d, %v), want %d", tt.response, status, err, tt.want)
+		}
+	}
+}
+
+func TestInformationalLambdaStatusIsBadGateway(t *testing.T) {
+	rec := serveLambdaResponse(t, http.MethodGet, `{"statusCode":101,"body":"switching"}`)
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+}
+
+func TestBodilessLambdaStatuses(t *testing.T) {
+	for _, status := range []int{http.StatusNoContent, http.StatusNotModified} {
+		rec := serveLambdaResponse(t, http.MethodGet,
+			`{"statusCode":`+strconv.Itoa(status)+`,"headers":{"ETag":"\"v1\""},"body":"must not be sent"}`)
+		if rec.Code != status {
+			t.Errorf("%d: status = %d", status, rec.Code)
+		}
+		if rec.Body.Len() != 0 {
+			t.Errorf("%d: body = %q, want none", status, rec.Body.String())
+		}
+		if cl := rec.Header().Get("Content-Length"); cl != "" {
+			t.Errorf("%d: Content-Length = %q, want none", status, cl)
+		}
+		if etag := rec.Header().Get("ETag"); etag != `"v1"` {
+			t.Errorf("%d: ETag = %q", status, etag)
+		}
+	}
+}
+
+func TestRedirectLambdaResponse(t *testing.T) {
+	rec := serveLambdaResponse(t, http.MethodGet,
+		`{"statusCode":302,"headers":{"Location":"https://example.com/next"},"body":"moved"}`)
+	if rec.Code != http.StatusFound {
+		t.Fatalf("status = %d, want 302", rec.Code)
+	}
+	if loc := rec.Header().Get("Location"); loc != "https://example.com/next" {
+		t.Errorf("Location = %q", loc)
+	}
+	if rec.Body.String() != "moved" {
+		t.Errorf("body = %q, want %q", rec.Body.String(), "moved")
+	}
+}
+
+func TestLambdaCookiesBecomeSeparateSetCookieHeaders(t *testing.T) {
+	rec := serveLambdaResponse(t, http.MethodGet,
+		`{"statusCode":200,"cookies":["session=abc; HttpOnly","theme=dark; Path=/"],"body":"ok"}`)
+	got := rec.Result().Header.Values("Set-Cookie")
+	want := []string{"session=abc; HttpOnly", "theme=dark; Path=/"}
+	if len(got) != len(want) {
+		t.Fatalf("Set-Cookie = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Set-Cookie[%d] = %q, want %q", i, got[i], want[i])
+		}
+	}
+}
+
+func TestHeadRequestGetsNoResponseBody(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.TransformResponse = true
+	var eventMethod string
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var event struct {
+			RequestContext struct {
+				HTTP struct {
+					Method string `json:"method"`
+				} `json:"http"`
+			} `json:"requestContext"`
+		}
+		_ = json.NewDecoder(req.Body).Decode(&event)
+		eventMethod = event.RequestContext.HTTP.Method
+		_, _ = rw.Write([]byte(`{"statusCode":200,"headers":{"Content-Type":"text/plain"},"body":"hello"}`))
+	})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/resource", nil))
+
+	if eventMethod != http.MethodHead {
+		t.Errorf("event method = %q, want HEAD", eventMethod)
+	}
+	if rec.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200", rec.Code)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("HEAD response body = %q, want none", rec.Body.String())
+	}
+	// The length a GET would have returned
+	if cl := rec.Header().Get("Content-Length"); cl != "5" {
+		t.Errorf("Content-Length = %q, want 5", cl)
+	}
+}
+
+func TestResponseWithoutStatusCodeIsPassedThrough(t *testing.T) {
+	envelope := `{"errorMessage":"boom","errorType":"Error"}`
+
+	status, header, body, err := ParseLambdaResponse(strings.NewReader(envelope))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || string(body) != envelope || header.Get("Content-Type") != "application/json" {
+		t.Errorf("got (%d, %v, %q), want 200 application/json with the whole payload", status, header, body)
+	}
+
+	rec := serveLambdaResponse(t, http.MethodGet, envelope)
+	if rec.Code != http.StatusOK || rec.Body.String() != envelope {
+		t.Errorf("client got %d %q, want 200 with the payload, not a blank body", rec.Code, rec.Body.String())
+	}
+
+	if _, _, _, err := ParseLambdaResponse(strings.NewReader("not json")); err == nil {
+		t.Error("non-JSON payload accepted")
+	}
+}
+
+func TestFunctionErrorIsBadGateway(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.TransformResponse = true
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set(functionErrorHeader, "Unhandled")
+		_, _ = rw.Write([]byte(`{"errorMessage":"boom","errorType":"Error"}`))
+	})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/resource", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("status = %d, want 502", rec.Code)
+	}
+}
+
+func TestUpstreamFailuresLogTheClientRequest(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.TransformResponse = true
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = rw.Write([]byte("panic: runtime error"))
+	})
+	rt, err := NewHandler(next, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var logs bytes.Buffer
+	rt.logger = log.New(&logs, "", 0)
+	rt.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodDelete, "/orders/7", nil))
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(lines) < 2 {
+		t.Fatalf("want the upstream body and the error logged, got:\n%s", logs.String())
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, `method=DELETE path="/orders/7"`) {
+			t.Errorf("log line lacks the client's method and path: %s", line)
+		}
+	}
+}
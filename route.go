@@ -0,0 +1,87 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"fmt"
+	"strings"
+)
+
+// routeTemplate is a parsed API Gateway style route such as
+// /users/{id}/orders/{orderId} or /files/{proxy+}.
+type routeTemplate struct {
+	raw      string
+	segments []string
+}
+
+// parseRouteTemplate validates and splits a route template. A greedy
+// {name+} variable is only allowed as the last segment.
+func parseRouteTemplate(raw string) (*routeTemplate, error) {
+	if !strings.HasPrefix(raw, "/") {
+		return nil, fmt.Errorf("invalid routeTemplate %q: must start with /", raw)
+	}
+	segments := strings.Split(strings.Trim(raw, "/"), "/")
+	for i, seg := range segments {
+		name, greedy, isVar := templateVar(seg)
+		if !isVar {
+			if strings.ContainsAny(seg, "{}") {
+				return nil, fmt.Errorf("invalid routeTemplate %q: malformed segment %q", raw, seg)
+			}
+			continue
+		}
+		if name == "" {
+			return nil, fmt.Errorf("invalid routeTemplate %q: empty variable name", raw)
+		}
+		if greedy && i != len(segments)-1 {
+			return nil, fmt.Errorf("invalid routeTemplate %q: greedy variable %q must be last", raw, seg)
+		}
+	}
+	return &routeTemplate{raw: raw, segments: segments}, nil
+}
+
+// templateVar reports whether seg is a {name} or {name+} variable.
+func templateVar(seg string) (name string, greedy, ok bool) {
+	if !strings.HasPrefix(seg, "{") || !strings.HasSuffix(seg, "}") {
+		return "", false, false
+	}
+	name = seg[1 : len(seg)-1]
+	if strings.HasSuffix(name, "+") {
+		return strings.TrimSuffix(name, "+"), true, true
+	}
+	return name, false, true
+}
+
+// match extracts the path parameters from the (already decoded) path. It
+// reports false when the path doesn't fit the template.
+func (t *routeTemplate) match(path string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	params := make(map[string]string)
+
+	for i, seg := range t.segments {
+		name, greedy, isVar := templateVar(seg)
+		if greedy {
+			rest := strings.Join(parts[i:], "/")
+			if i >= len(parts) || rest == "" {
+				return nil, false
+			}
+			params[name] = rest
+			return params, true
+		}
+		if i >= len(parts) {
+			return nil, false
+		}
+		if !isVar {
+			if parts[i] != seg {
+				return nil, false
+			}
+			continue
+		}
+		if parts[i] == "" {
+			return nil, false
+		}
+		params[name] = parts[i]
+	}
+
+	if len(parts) != len(t.segments) {
+		return nil, false
+	}
+	return params, true
+}
@@ -0,0 +1,109 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestBasePathWithTrailingSlashMode(t *testing.T) {
+	tests := []struct {
+		basePath, mode, path string
+		want                 string
+	}{
+		{basePath: "/v1", mode: trailingSlashStrip, path: "/", want: "/v1"},
+		{basePath: "/v1", mode: trailingSlashStrip, path: "/users/", want: "/v1/users"},
+		{basePath: "/v1", mode: trailingSlashAdd, path: "/", want: "/v1/"},
+		{basePath: "/v1", mode: trailingSlashAdd, path: "/users", want: "/v1/users/"},
+		{basePath: "", mode: trailingSlashStrip, path: "/", want: "/"},
+		{basePath: "", mode: trailingSlashAdd, path: "/", want: "/"},
+	}
+	for _, tt := range tests {
+		cfg := CreateConfig()
+		cfg.BasePath = tt.basePath
+		cfg.TrailingSlash = tt.mode
+		event := captureEvent(t, cfg, httptest.NewRequest(http.MethodGet, tt.path, nil))
+
+		if got := event["rawPath"]; got != tt.want {
+			t.Errorf("basePath=%q mode=%s path=%q: rawPath = %v, want %q", tt.basePath, tt.mode, tt.path, got, tt.want)
+		}
+		if got := event["routeKey"]; got != "GET "+tt.want {
+			t.Errorf("basePath=%q mode=%s path=%q: routeKey = %v", tt.basePath, tt.mode, tt.path, got)
+		}
+	}
+}
+
+func TestRouteTemplateMatch(t *testing.T) {
+	tests := []struct {
+		template, path string
+		want           map[string]string // nil means no match
+	}{
+		{template: "/users/{id}", path: "/users/42", want: map[string]string{"id": "42"}},
+		{template: "/users/{id}", path: "/users/42/", want: map[string]string{"id": "42"}},
+		{template: "/users/{id}/", path: "/users/42", want: map[string]string{"id": "42"}},
+		{template: "/users/{id}", path: "/users/42/orders"},
+		{template: "/users/{id}", path: "/users/"},
+		{template: "/users/{id}", path: "/users"},
+		{template: "/users/{id}", path: "/accounts/42"},
+		// A greedy variable takes the rest of the path, a plain one a segment
+		{template: "/files/{proxy+}", path: "/files/a", want: map[string]string{"proxy": "a"}},
+		{template: "/files/{proxy+}", path: "/files/a/b/c.txt", want: map[string]string{"proxy": "a/b/c.txt"}},
+		{template: "/files/{proxy+}", path: "/files/a/b/", want: map[string]string{"proxy": "a/b"}},
+		{template: "/files/{proxy+}", path: "/files"},
+		{template: "/files/{proxy+}", path: "/files/"},
+		{template: "/files/{dir}/{proxy+}", path: "/files/docs/x/y", want: map[string]string{"dir": "docs", "proxy": "x/y"}},
+		{template: "/files/{dir}/{proxy+}", path: "/files/docs"},
+		{template: "/{proxy+}", path: "/anything/at/all", want: map[string]string{"proxy": "anything/at/all"}},
+		{template: "/", path: "/", want: map[string]string{}},
+		{template: "/", path: "/x"},
+	}
+	for _, tt := range tests {
+		route, err := parseRouteTemplate(tt.template)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.template, err)
+		}
+		got, ok := route.match(tt.path)
+		if tt.want == nil {
+			if ok {
+				t.Errorf("%s matched %s with %v, want no match", tt.template, tt.path, got)
+			}
+			continue
+		}
+		if !ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s on %s = (%v, %t), want %v", tt.template, tt.path, got, ok, tt.want)
+		}
+	}
+}
+
+func TestParseRouteTemplateErrors(t *testing.T) {
+	for _, raw := range []string{"users/{id}", "/files/{proxy+}/meta", "/users/{}", "/users/{id", "/users/x{id}"} {
+		if _, err := parseRouteTemplate(raw); err == nil {
+			t.Errorf("parseRouteTemplate(%q) accepted an invalid template", raw)
+		}
+	}
+}
+
+func TestRouteTemplateInEvent(t *testing.T) {
+	cfg := CreateConfig()
+	cfg.RouteTemplate = "/files/{proxy+}"
+	cfg.TrailingSlash = trailingSlashStrip
+	event := eventFor(t, cfg, httptest.NewRequest(http.MethodGet, "/files/a/b/", nil), fixedTime, "req-1")
+
+	if got := event["routeKey"]; got != "GET /files/{proxy+}" {
+		t.Errorf("routeKey = %v", got)
+	}
+	params, _ := event["pathParameters"].(map[string]interface{})
+	if params["proxy"] != "a/b" {
+		t.Errorf("pathParameters = %v", params)
+	}
+
+	// A path outside the template keeps the literal route key
+	event = eventFor(t, cfg, httptest.NewRequest(http.MethodGet, "/other", nil), fixedTime, "req-1")
+	if got := event["routeKey"]; got != "GET /other" {
+		t.Errorf("unmatched routeKey = %v", got)
+	}
+	if _, ok := event["pathParameters"]; ok {
+		t.Error("unmatched path has pathParameters")
+	}
+}
@@ -0,0 +1,151 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// sourceIP determines the client IP for the event. A configured source IP
+// header wins, then the leftmost X-Forwarded-For entry when UseXForwardedFor
+// is on, then a trusted X-Forwarded-For chain, then the connection address.
+func (rt *LambdaRequestTransformer) sourceIP(req *http.Request) string {
+	peerIP := remoteIP(req.RemoteAddr)
+
+	if rt.sourceIPHeader != "" {
+		value := req.Header.Get(rt.sourceIPHeader)
+		if i := strings.Index(value, ","); i != -1 {
+			value = value[:i]
+		}
+		if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+			return ip.String()
+		}
+	}
+
+	if rt.useXForwardedFor {
+		value := req.Header.Get("X-Forwarded-For")
+		if i := strings.Index(value, ","); i != -1 {
+			value = value[:i]
+		}
+		if ip := net.ParseIP(strings.TrimSpace(value)); ip != nil {
+			return ip.String()
+		}
+	}
+
+	if fwdIP := rt.forwardedClientIP(req, peerIP); fwdIP != "" {
+		return fwdIP
+	}
+	return peerIP
+}
+
+// remoteIP returns the IP literal of a connection address, without port or
+// IPv6 brackets: "1.2.3.4", "1.2.3.4:5678", "[::1]" and "[::1]:80" all
+// yield the bare address. Anything unparseable is returned as is.
+func remoteIP(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	} else {
+		host = strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// scheme reports the scheme the client used: X-Forwarded-Proto ("http" or
+// "https") when the direct peer is a trusted proxy, else whether this
+// connection is TLS.
+func (rt *LambdaRequestTransformer) scheme(req *http.Request) string {
+	if len(rt.trustedProxies) > 0 {
+		if peer := net.ParseIP(remoteIP(req.RemoteAddr)); peer != nil && rt.isTrusted(peer) {
+			proto := req.Header.Get("X-Forwarded-Proto")
+			if i := strings.Index(proto, ","); i != -1 {
+				proto = proto[:i] // leftmost is the client-facing hop
+			}
+			switch proto = strings.ToLower(strings.TrimSpace(proto)); proto {
+			case "http", "https":
+				return proto
+			}
+		}
+	}
+	if req.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// parseCIDRs parses a list of CIDR ranges. Bare IPs are accepted and treated
+// as single-host ranges.
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", v, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+// isTrusted reports whether ip falls inside one of the trusted proxy ranges.
+func (rt *LambdaRequestTransformer) isTrusted(ip net.IP) bool {
+	for _, n := range rt.trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedClientIP resolves the client address from X-Forwarded-For. The
+// header is only honored when the direct peer is a trusted proxy; hops are
+// then walked from the right, collapsing trusted proxies, and the first
+// untrusted address is returned. Hops may carry a port. It returns "" when
+// the header is absent, the peer is untrusted, a hop is malformed before an
+// untrusted one is found, or every hop is trusted.
+func (rt *LambdaRequestTransformer) forwardedClientIP(req *http.Request, peerIP string) string {
+	if len(rt.trustedProxies) == 0 {
+		return ""
+	}
+	peer := net.ParseIP(peerIP)
+	if peer == nil || !rt.isTrusted(peer) {
+		return ""
+	}
+
+	var hops []string
+	for _, line := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(line, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		// Some proxies append the client port, e.g. "[2001:db8::1]:443"
+		ip := net.ParseIP(remoteIP(hops[i]))
+		if ip == nil {
+			// Anything left of a malformed hop can't be trusted
+			return ""
+		}
+		if !rt.isTrusted(ip) {
+			return ip.String()
+		}
+	}
+	return ""
+}
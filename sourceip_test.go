@@ -0,0 +1,79 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRemoteIP(t *testing.T) {
+	tests := []struct {
+		addr, want string
+	}{
+		{addr: "1.2.3.4", want: "1.2.3.4"},
+		{addr: "1.2.3.4:5678", want: "1.2.3.4"},
+		{addr: "[::1]", want: "::1"},
+		{addr: "[::1]:80", want: "::1"},
+		{addr: "[2001:DB8::1]:443", want: "2001:db8::1"},
+		{addr: "not-an-ip", want: "not-an-ip"},
+	}
+	for _, tt := range tests {
+		if got := remoteIP(tt.addr); got != tt.want {
+			t.Errorf("remoteIP(%q) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestSourceIPInEvent(t *testing.T) {
+	for _, addr := range []string{"[::1]", "[::1]:80"} {
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		req.RemoteAddr = addr
+		event := eventFor(t, CreateConfig(), req, fixedTime, "req-1")
+
+		reqCtx := event["requestContext"].(map[string]interface{})
+		if got := reqCtx["http"].(map[string]interface{})["sourceIp"]; got != "::1" {
+			t.Errorf("RemoteAddr %q: sourceIp = %v, want ::1", addr, got)
+		}
+	}
+}
+
+func TestTrustedProxyXForwardedFor(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}
+	tests := []struct {
+		name, peer string
+		xff        []string
+		want       string
+	}{
+		{name: "untrusted peer ignores XFF", peer: "203.0.113.5:4000", xff: []string{"198.51.100.7"}, want: "203.0.113.5"},
+		{name: "no XFF", peer: "10.0.0.1:4000", want: "10.0.0.1"},
+		{name: "single trusted proxy", peer: "10.0.0.1:4000", xff: []string{"198.51.100.7"}, want: "198.51.100.7"},
+		{name: "chain of trusted proxies", peer: "10.0.0.1:4000",
+			xff: []string{"198.51.100.7, 203.0.113.9, 192.168.1.1, 10.2.3.4"}, want: "203.0.113.9"},
+		{name: "chain across header lines", peer: "10.0.0.1:4000",
+			xff: []string{"198.51.100.7, 203.0.113.9", "10.2.3.4"}, want: "203.0.113.9"},
+		{name: "spoofed leftmost entry", peer: "10.0.0.1:4000", xff: []string{"1.1.1.1, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "malformed hop", peer: "10.0.0.1:4000", xff: []string{"198.51.100.7, bogus, 10.2.3.4"}, want: "10.0.0.1"},
+		{name: "malformed hop left of client", peer: "10.0.0.1:4000", xff: []string{"bogus, 198.51.100.7"}, want: "198.51.100.7"},
+		{name: "empty hop", peer: "10.0.0.1:4000", xff: []string{"198.51.100.7,,10.2.3.4"}, want: "10.0.0.1"},
+		{name: "IPv4 hop with port", peer: "10.0.0.1:4000", xff: []string{"198.51.100.7:5555"}, want: "198.51.100.7"},
+		{name: "IPv6 hop", peer: "[fd00::1]:4000", xff: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{name: "IPv6 hop with port", peer: "[fd00::1]:4000", xff: []string{"[2001:db8::1]:443, fd00::2"}, want: "2001:db8::1"},
+		{name: "IPv6 peer without port", peer: "fd00::1", xff: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{name: "every hop trusted", peer: "10.0.0.1:4000", xff: []string{"10.9.9.9, 192.168.1.1"}, want: "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		cfg := CreateConfig()
+		cfg.TrustedProxies = trusted
+		req := httptest.NewRequest(http.MethodGet, "/hello", nil)
+		req.RemoteAddr = tt.peer
+		for _, v := range tt.xff {
+			req.Header.Add("X-Forwarded-For", v)
+		}
+		event := eventFor(t, cfg, req, fixedTime, "req-1")
+
+		reqCtx := event["requestContext"].(map[string]interface{})
+		if got := reqCtx["http"].(map[string]interface{})["sourceIp"]; got != tt.want {
+			t.Errorf("%s: sourceIp = %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"unicode/utf8"
+)
+
+// spillFile is a request body buffered on disk. Closing it removes the file;
+// Close is safe to call more than once and from several goroutines.
+type spillFile struct {
+	*os.File
+	once sync.Once
+
+	// validUTF8 reports whether the spilled bytes are valid UTF-8
+	validUTF8 bool
+}
+
+// Close closes and deletes the temp file.
+func (f *spillFile) Close() error {
+	var err error
+	f.once.Do(func() {
+		err = f.File.Close()
+		if rmErr := os.Remove(f.Name()); err == nil {
+			err = rmErr
+		}
+	})
+	return err
+}
+
+// spillBody reads up to SpillBodyBytes of the request body into memory. A
+// body that fits is put back on req.Body, followed by whatever the client
+// has left to send, and nil is returned so readBody handles it as usual.
+// A larger body is copied into a temp file, subject to MaxBodyBytes, and
+// the file is returned positioned at its start along with the first bytes
+// read (for content sniffing). The caller must Close the file.
+func (rt *LambdaRequestTransformer) spillBody(req *http.Request) (*spillFile, []byte, error) {
+	if rt.maxBodyBytes > 0 && req.ContentLength > rt.maxBodyBytes {
+		req.Body.Close()
+		return nil, nil, errBodyTooLarge
+	}
+	head, err := io.ReadAll(io.LimitReader(req.Body, rt.spillBodyBytes+1))
+	if err != nil && err != io.ErrUnexpectedEOF {
+		req.Body.Close()
+		return nil, nil, err
+	}
+	if err == nil && int64(len(head)) <= rt.spillBodyBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(head), req.Body), req.Body}
+		return nil, nil, nil
+	}
+	defer req.Body.Close()
+
+	tmp, err := os.CreateTemp("", "lambda-body-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &spillFile{File: tmp}
+
+	var rest io.Reader = req.Body
+	if rt.maxBodyBytes > 0 {
+		rest = &limitedReader{r: rest, remaining: rt.maxBodyBytes - int64(len(head))}
+	}
+	var check utf8Checker
+	n, err := io.Copy(io.MultiWriter(f, &check), io.MultiReader(bytes.NewReader(head), rest))
+	f.validUTF8 = check.valid()
+	if err == io.ErrUnexpectedEOF && req.ContentLength > 0 {
+		// The client hung up before sending the declared length
+		err = nil
+	}
+	if err == nil && req.ContentLength > 0 && n != req.ContentLength {
+		mismatch := &lengthMismatchError{declared: req.ContentLength, actual: n}
+		if !rt.lenientContentLength {
+			err = mismatch
+		} else {
+			rt.logger.Printf("name=%s method=%s path=%q warning=%q", rt.name, req.Method, req.URL.Path, mismatch.Error())
+		}
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return f, head, nil
+}
+
+// utf8Checker is an io.Writer that tracks whether everything written to it
+// is valid UTF-8. Sequences split across writes are held back until
+// complete.
+type utf8Checker struct {
+	pending []byte
+	invalid bool
+}
+
+func (c *utf8Checker) Write(p []byte) (int, error) {
+	if c.invalid {
+		return len(p), nil
+	}
+	data := p
+	if len(c.pending) > 0 {
+		data = append(c.pending, p...)
+		c.pending = nil
+	}
+	// Hold back a trailing incomplete sequence
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(data[:cut]) {
+		c.invalid = true
+		return len(p), nil
+	}
+	c.pending = append(c.pending, data[cut:]...)
+	return len(p), nil
+}
+
+// valid reports whether all bytes written form complete, valid UTF-8.
+func (c *utf8Checker) valid() bool {
+	return !c.invalid && len(c.pending) == 0
+}
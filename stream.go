@@ -0,0 +1,194 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"io"
+	"strings"
+	"unicode/utf8"
+)
+
+// streamedBody describes a request body that is spliced into the event
+// while it is sent upstream instead of being buffered.
+type streamedBody struct {
+	src         io.ReadCloser
+	placeholder string
+	base64      bool
+	gunzip      bool
+
+	// handedOff is set once eventReader owns src and will close it
+	handedOff bool
+}
+
+// eventReader returns a reader producing the event JSON with the client
+// body streamed in place of the placeholder string. An event without the
+// placeholder (e.g. a template that omits the body) is sent as is. The
+// caller must Close the reader; that also stops the writing goroutine.
+func (rt *LambdaRequestTransformer) eventReader(event []byte, body *streamedBody) io.ReadCloser {
+	body.handedOff = true
+	marker := []byte(`"` + body.placeholder + `"`)
+	i := bytes.Index(event, marker)
+	if i == -1 {
+		body.src.Close()
+		return io.NopCloser(bytes.NewReader(event))
+	}
+	// Keep the surrounding quotes in prefix and suffix
+	prefix, suffix := event[:i+1], event[i+len(marker)-1:]
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.src.Close()
+		pw.CloseWithError(rt.writeStreamedEvent(pw, prefix, suffix, body))
+	}()
+	return pr
+}
+
+// writeStreamedEvent writes prefix, the encoded body and suffix to w.
+func (rt *LambdaRequestTransformer) writeStreamedEvent(w io.Writer, prefix, suffix []byte, body *streamedBody) error {
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+
+	var r io.Reader = body.src
+	if body.gunzip {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		r = zr
+	}
+	if rt.maxBodyBytes > 0 {
+		r = &limitedReader{r: r, remaining: rt.maxBodyBytes}
+	}
+
+	if body.base64 {
+		enc := base64.NewEncoder(base64.StdEncoding, w)
+		if _, err := io.Copy(enc, r); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	} else {
+		esc := &jsonStringWriter{w: w}
+		if _, err := io.Copy(esc, r); err != nil {
+			return err
+		}
+		if err := esc.Close(); err != nil {
+			return err
+		}
+	}
+
+	_, err := w.Write(suffix)
+	return err
+}
+
+// limitedReader fails with errBodyTooLarge once more than remaining bytes
+// have been read, unlike io.LimitReader which silently truncates.
+type limitedReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errBodyTooLarge
+	}
+	return n, err
+}
+
+// errStreamInvalidUTF8 fails a streamed text body that isn't valid UTF-8.
+// By then isBase64Encoded:false has been sent, and replacing the bytes with
+// U+FFFD would silently corrupt the body.
+var errStreamInvalidUTF8 = errors.New("streamed text body is not valid UTF-8")
+
+// jsonStringWriter escapes bytes for the inside of a JSON string literal.
+// Invalid UTF-8 fails with errStreamInvalidUTF8; sequences split across
+// writes are held back until complete.
+type jsonStringWriter struct {
+	w       io.Writer
+	pending []byte
+	buf     bytes.Buffer
+}
+
+const hexDigits = "0123456789abcdef"
+
+// jsonStringFlushBytes bounds the escape buffer, so one large Write (e.g.
+// from a bytes.Reader's WriteTo) doesn't buffer the whole body.
+const jsonStringFlushBytes = 32 << 10
+
+func (j *jsonStringWriter) Write(p []byte) (int, error) {
+	data := p
+	if len(j.pending) > 0 {
+		data = append(j.pending, p...)
+		j.pending = nil
+	}
+
+	j.buf.Reset()
+	for len(data) > 0 {
+		if j.buf.Len() >= jsonStringFlushBytes {
+			if _, err := j.w.Write(j.buf.Bytes()); err != nil {
+				return 0, err
+			}
+			j.buf.Reset()
+		}
+		c := data[0]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				j.buf.WriteByte('\\')
+				j.buf.WriteByte(c)
+			case c == '\n':
+				j.buf.WriteString(`\n`)
+			case c == '\r':
+				j.buf.WriteString(`\r`)
+			case c == '\t':
+				j.buf.WriteString(`\t`)
+			case c < 0x20:
+				j.buf.WriteString(`\u00`)
+				j.buf.WriteByte(hexDigits[c>>4])
+				j.buf.WriteByte(hexDigits[c&0xF])
+			default:
+				j.buf.WriteByte(c)
+			}
+			data = data[1:]
+			continue
+		}
+
+		r, size := utf8.DecodeRune(data)
+		if r == utf8.RuneError && size == 1 {
+			if !utf8.FullRune(data) {
+				// Incomplete sequence at the end of this write
+				j.pending = append([]byte(nil), data...)
+				break
+			}
+			return 0, errStreamInvalidUTF8
+		}
+		j.buf.Write(data[:size])
+		data = data[size:]
+	}
+
+	if _, err := j.w.Write(j.buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close fails if the body ended in the middle of a UTF-8 sequence.
+func (j *jsonStringWriter) Close() error {
+	if len(j.pending) == 0 {
+		return nil
+	}
+	j.pending = nil
+	return errStreamInvalidUTF8
+}
+
+// newBodyPlaceholder returns an unguessable token that can't collide with
+// client-supplied event content.
+func newBodyPlaceholder() string {
+	return "lambda-body-" + strings.ReplaceAll(generateUUID(), "-", "")
+}
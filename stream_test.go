@@ -0,0 +1,154 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestStreamedEventDoesNotLeakWhenBodyIsIgnored(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(*Config)
+	}{
+		{name: "streamBody", setup: func(c *Config) { c.StreamBody = true }},
+		{name: "spillBodyBytes", setup: func(c *Config) { c.SpillBodyBytes = 16 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			tt.setup(cfg)
+			// next answers without touching the event body
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusAccepted)
+			})
+			h, err := New(context.Background(), next, cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			body := bytes.Repeat([]byte("x"), 64<<10)
+			before := runtime.NumGoroutine()
+			for i := 0; i < 50; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "text/plain")
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				if rec.Code != http.StatusAccepted {
+					t.Fatalf("status = %d, want 202", rec.Code)
+				}
+			}
+
+			// The writers exit asynchronously once their pipe is closed
+			deadline := time.Now().Add(2 * time.Second)
+			for runtime.NumGoroutine() > before+2 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if after := runtime.NumGoroutine(); after > before+2 {
+				t.Errorf("goroutines went from %d to %d", before, after)
+			}
+		})
+	}
+}
+
+func TestStreamedEventMatchesBufferedEvent(t *testing.T) {
+	body := "line one\nline \"two\"\tcafé"
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader([]byte(body)))
+		req.Header.Set("Content-Type", "text/plain")
+		return req
+	}
+
+	buffered := captureEvent(t, CreateConfig(), newReq())
+	cfg := CreateConfig()
+	cfg.StreamBody = true
+	streamed := captureEvent(t, cfg, newReq())
+
+	if streamed["body"] != buffered["body"] || streamed["body"] != body {
+		t.Errorf("streamed body = %q, buffered body = %q", streamed["body"], buffered["body"])
+	}
+}
+
+// BenchmarkEvent10MB compares allocations for a 10 MB text body read into
+// memory against one spliced into the event as it is sent.
+func BenchmarkEvent10MB(b *testing.B) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 10<<20/16)
+	for _, bc := range []struct {
+		name  string
+		setup func(*Config)
+	}{
+		{name: "buffered", setup: func(*Config) {}},
+		{name: "streamBody", setup: func(c *Config) { c.StreamBody = true }},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			cfg := CreateConfig()
+			cfg.MaxBodyBytes = 0
+			bc.setup(cfg)
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = io.Copy(io.Discard, req.Body)
+			})
+			h, err := New(context.Background(), next, cfg, "bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(body)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body))
+				req.Header.Set("Content-Type", "text/plain")
+				h.ServeHTTP(httptest.NewRecorder(), req)
+			}
+		})
+	}
+}
+
+func TestStreamedInvalidUTF8FailsTheStream(t *testing.T) {
+	invalid := "caf\xe9 au lait"
+	tests := []struct {
+		name  string
+		body  []byte
+		ce    string
+		setup func(*Config)
+	}{
+		{name: "streamBody", body: []byte(invalid), setup: func(c *Config) { c.StreamBody = true }},
+		{name: "streamBody truncated sequence", body: []byte("ok\xe6\x97"), setup: func(c *Config) { c.StreamBody = true }},
+		{name: "spilled gzip", body: gzipString(t, invalid), ce: "gzip",
+			setup: func(c *Config) { c.SpillBodyBytes = 4; c.DecompressRequest = true }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			tt.setup(cfg)
+			var readErr error
+			var event []byte
+			next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				event, readErr = io.ReadAll(req.Body)
+			})
+			h, err := New(context.Background(), next, cfg, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "text/plain")
+			if tt.ce != "" {
+				req.Header.Set("Content-Encoding", tt.ce)
+			}
+			h.ServeHTTP(httptest.NewRecorder(), req)
+
+			if !errors.Is(readErr, errStreamInvalidUTF8) {
+				t.Errorf("reading the event: err = %v, want errStreamInvalidUTF8", readErr)
+			}
+			if bytes.Contains(event, []byte("\ufffd")) {
+				t.Errorf("event carries a replacement character: %q", event)
+			}
+		})
+	}
+}
@@ -1,158 +1,1459 @@
 package traefik_lambdarequesttransformer
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/rand"
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"log"
+	"mime"
+	"mime/multipart"
 	"net"
 	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
-// Config holds the plugin configuration (no configurable fields in this plugin).
-type Config struct{}
+// defaultMaxBodyBytes caps how much of the client body is read into the
+// event. It matches the synchronous Lambda invocation payload limit (6 MB).
+const defaultMaxBodyBytes = 6 << 20
+
+// Supported API Gateway payload format versions.
+const (
+	payloadVersion1 = "1.0"
+	payloadVersion2 = "2.0"
+)
+
+// Supported event formats.
+const (
+	eventFormatAPIGateway  = "apigateway"
+	eventFormatALB         = "alb"
+	eventFormatFunctionURL = "functionurl"
+)
+
+// defaultContextValue is used for stage, accountId and apiId when unset.
+const defaultContextValue = "local"
+
+// defaultRequestIDHeader carries an upstream-assigned request id.
+const defaultRequestIDHeader = "X-Request-Id"
+
+// defaultOriginalMethodHeader carries the client's method on the rewritten request.
+const defaultOriginalMethodHeader = "X-Original-Method"
+
+// defaultFallbackDomainName stands in for a missing Host header.
+const defaultFallbackDomainName = "localhost"
+
+// defaultForwardContentType is the Content-Type of the rewritten request.
+const defaultForwardContentType = "application/json"
+
+// defaultInvokePath is the Lambda runtime interface emulator invoke endpoint.
+const defaultInvokePath = "/2015-03-31/functions/function/invocations"
+
+// Supported generated request id versions.
+const (
+	requestIDVersion4 = "v4"
+	requestIDVersion7 = "v7"
+)
+
+// Supported generated request id formats.
+const (
+	requestIDFormatUUID  = "uuid"
+	requestIDFormatAPIGW = "apigw"
+)
+
+// Supported trailing slash modes.
+const (
+	trailingSlashPreserve = "preserve"
+	trailingSlashStrip    = "strip"
+	trailingSlashAdd      = "add"
+)
+
+// Supported header key casing modes.
+const (
+	headerCaseCanonical = "canonical"
+	headerCaseLower     = "lower"
+)
+
+// timeFormatAPIGateway selects the CLF-style layout API Gateway uses for
+// requestContext.time, e.g. 09/Apr/2015:12:34:56 +0000.
+const (
+	timeFormatAPIGateway = "apigateway"
+	apiGatewayTimeLayout = "02/Jan/2006:15:04:05 -0700"
+)
+
+// requestIDTrailer is the response trailer carrying the request id, after
+// AWS's x-amzn-RequestId convention.
+const requestIDTrailer = "X-Amzn-RequestId"
+
+// defaultCompressEventBytes is the smallest event CompressEvent gzips;
+// below it the gzip framing costs more than it saves.
+const defaultCompressEventBytes = 1 << 10
+
+// defaultOptOutHeader lets a single request skip transformation.
+const defaultOptOutHeader = "X-Lambda-Transform"
+
+// Config holds the plugin configuration.
+type Config struct {
+	// Stage, AccountID and APIID populate the matching requestContext fields.
+	Stage     string `json:"stage,omitempty"`
+	AccountID string `json:"accountId,omitempty"`
+	APIID     string `json:"apiId,omitempty"`
+
+	// SkipPaths lists path prefixes (matched segment-wise) that are forwarded
+	// without transformation, e.g. health checks.
+	SkipPaths []string `json:"skipPaths,omitempty"`
+
+	// TransformMethods restricts transformation to these HTTP methods; others
+	// are forwarded untouched. When empty, every method is transformed.
+	TransformMethods []string `json:"transformMethods,omitempty"`
+
+	// EventTemplate, when set, is a text/template whose output replaces the
+	// built-in event. It must render valid JSON; the "json" function encodes
+	// a value as JSON.
+	EventTemplate string `json:"eventTemplate,omitempty"`
+
+	// DomainName overrides the requestContext.domainName derived from the
+	// Host header; domainPrefix is derived from it.
+	DomainName string `json:"domainName,omitempty"`
+
+	// FallbackDomainName is used as requestContext.domainName when the
+	// request has no Host (e.g. HTTP/1.0 clients). Defaults to "localhost".
+	FallbackDomainName string `json:"fallbackDomainName,omitempty"`
+
+	// AllowOrigins enables answering CORS preflight requests in the plugin.
+	// "*" allows any origin; otherwise a matching Origin is echoed.
+	// AllowMethods and AllowHeaders default to echoing what the preflight
+	// asked for.
+	AllowOrigins []string `json:"allowOrigins,omitempty"`
+	AllowMethods []string `json:"allowMethods,omitempty"`
+	AllowHeaders []string `json:"allowHeaders,omitempty"`
+
+	// OptOutHeader names a request header that, when set to "off", forwards
+	// that request untouched.
+	OptOutHeader string `json:"optOutHeader,omitempty"`
+
+	// StageVariables are emitted as the event's stageVariables.
+	StageVariables map[string]string `json:"stageVariables,omitempty"`
+
+	// EventFormat selects the invoking service: "apigateway" (default),
+	// "alb" (Application Load Balancer target group) or "functionurl"
+	// (Lambda function URL).
+	EventFormat string `json:"eventFormat,omitempty"`
+
+	// PayloadVersion selects the API Gateway event shape: "2.0" (HTTP API,
+	// default) or "1.0" (REST API proxy integration).
+	PayloadVersion string `json:"payloadVersion,omitempty"`
+
+	// TargetGroupARN populates requestContext.elb.targetGroupArn in ALB events.
+	TargetGroupARN string `json:"targetGroupArn,omitempty"`
+
+	// IncludeMiddlewareName adds requestContext.middlewareName so a Lambda
+	// shared by several routes can tell them apart. The value is RouterName,
+	// or the middleware instance name Traefik passes to New.
+	IncludeMiddlewareName bool   `json:"includeMiddlewareName,omitempty"`
+	RouterName            string `json:"routerName,omitempty"`
+
+	// IncludeRawRequestURL adds requestContext.rawRequestURL, the client's
+	// URL as scheme://host/path?query with the path and query as sent, i.e.
+	// without PromoteHeaderToQuery additions.
+	IncludeRawRequestURL bool `json:"includeRawRequestUrl,omitempty"`
+
+	// BasePath is prepended to the path in rawPath, requestContext.http.path
+	// and routeKey, restoring a prefix stripped earlier in the chain.
+	BasePath string `json:"basePath,omitempty"`
+
+	// TimeFormat is the Go time layout of requestContext.time (requestTime in
+	// 1.0 events), or "apigateway" for API Gateway's CLF-style layout.
+	// Defaults to RFC 3339.
+	TimeFormat string `json:"timeFormat,omitempty"`
+
+	// RouteTemplate is matched against the request path to fill
+	// pathParameters and routeKey, e.g. /users/{id}/orders/{orderId}.
+	RouteTemplate string `json:"routeTemplate,omitempty"`
+
+	// TrailingSlash normalizes the event path (rawPath, routeKey and
+	// requestContext.http.path) before route matching: "preserve"
+	// (default), "strip" or "add". A bare "/" is never changed; the mode
+	// also applies after BasePath is prepended.
+	TrailingSlash string `json:"trailingSlash,omitempty"`
+
+	// RouteKey, when set, replaces the computed routeKey, e.g. "$default"
+	// for handlers registered on API Gateway's catch-all route.
+	RouteKey string `json:"routeKey,omitempty"`
+
+	// IncludeMultiValueQuery adds multiValueQueryStringParameters to 2.0
+	// events. The 1.0 format always carries it.
+	IncludeMultiValueQuery bool `json:"includeMultiValueQuery,omitempty"`
+
+	// JWTAuthorizer decodes a bearer JWT from the Authorization header into
+	// requestContext.authorizer.jwt of 2.0 events. The signature is not
+	// verified.
+	JWTAuthorizer bool `json:"jwtAuthorizer,omitempty"`
+
+	// AuthorizerContextHeaders maps request header names to authorizer
+	// context keys, emulating a Lambda authorizer that ran upstream.
+	AuthorizerContextHeaders map[string]string `json:"authorizerContextHeaders,omitempty"`
+
+	// IdentitySources lists the API Gateway identity source expressions
+	// resolved into identitySource, e.g. "$request.header.Authorization",
+	// "$request.querystring.token" or "$stageVariables.key". Empty uses the
+	// x-session-id header.
+	IdentitySources []string `json:"identitySources,omitempty"`
+
+	// ClientCert adds the mutual TLS client certificate (subject, issuer,
+	// serial, validity) to requestContext when the connection presented one.
+	ClientCert bool `json:"clientCert,omitempty"`
+
+	// RequestIDHeader names the header whose value, when present, is used as
+	// requestContext.requestId. The final id is echoed back on it.
+	RequestIDHeader string `json:"requestIdHeader,omitempty"`
+
+	// InvokePath is the path the rewritten request is sent to, e.g.
+	// /2015-03-31/functions/my-func:PROD/invocations.
+	InvokePath string `json:"invokePath,omitempty"`
+
+	// RequestIDVersion selects the UUID version of generated request ids:
+	// "v4" (random, default) or "v7" (time-ordered).
+	RequestIDVersion string `json:"requestIdVersion,omitempty"`
+
+	// RequestIDFormat selects the shape of generated request ids: "uuid"
+	// (default, see RequestIDVersion) or "apigw" for an HTTP API style
+	// opaque id such as "JKJaXmPLvHcESHA=".
+	RequestIDFormat string `json:"requestIdFormat,omitempty"`
+
+	// RequestIDPrefix and RequestIDSuffix wrap generated request ids, e.g.
+	// "eu-west-1-<uuid>". Ids taken from RequestIDHeader already carry any
+	// namespace from the hop that minted them and are left unchanged.
+	RequestIDPrefix string `json:"requestIdPrefix,omitempty"`
+	RequestIDSuffix string `json:"requestIdSuffix,omitempty"`
+
+	// RequestIDTrailer sends the request id as an X-Amzn-RequestId response
+	// trailer. Off by default since not every client reads trailers.
+	RequestIDTrailer bool `json:"requestIdTrailer,omitempty"`
+
+	// KeepOriginalPath leaves the request path as the client sent it instead
+	// of rewriting it to InvokePath. Meant for testing against mock servers;
+	// a real Lambda runtime only accepts the invoke path.
+	KeepOriginalPath bool `json:"keepOriginalPath,omitempty"`
+
+	// PreserveQuery keeps the client's query string on the rewritten URL. By
+	// default it is dropped since the event already carries it.
+	PreserveQuery bool `json:"preserveQuery,omitempty"`
+
+	// ForwardedHost sets X-Forwarded-Host on the outgoing request to the
+	// client's Host, unless a proxy already set it.
+	ForwardedHost bool `json:"forwardedHost,omitempty"`
+
+	// OriginalMethodHeader names the header on the outgoing request that
+	// carries the client's original method, since the request becomes a POST.
+	OriginalMethodHeader string `json:"originalMethodHeader,omitempty"`
+
+	// ForwardContentType is the Content-Type of the rewritten request,
+	// application/json by default, for emulators that expect another type.
+	// multipart/mixed requests (see BodyInlineLimit) keep their own type.
+	ForwardContentType string `json:"forwardContentType,omitempty"`
+
+	// Log writes a one-line record per transformed request to stderr. Errors
+	// are always logged.
+	Log bool `json:"log,omitempty"`
+
+	// DryRun answers every transformed request with the generated event JSON
+	// (200, application/json) instead of calling the upstream. For debugging.
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// VerboseErrors adds the internal error text as "detail" to JSON error
+	// responses. Useful while debugging; leave off in production.
+	VerboseErrors bool `json:"verboseErrors,omitempty"`
+
+	// Metrics enables the counters lambda_transform_requests_total,
+	// lambda_transform_errors_total and the lambda_transform_payload_bytes
+	// histogram.
+	Metrics bool `json:"metrics,omitempty"`
+
+	// MetricsPath, when set with Metrics, serves those counters as JSON at
+	// this request path instead of transforming the request.
+	MetricsPath string `json:"metricsPath,omitempty"`
+
+	// TransformResponse unwraps the Lambda proxy response (statusCode,
+	// headers, body) into a regular HTTP response for the client.
+	TransformResponse bool `json:"transformResponse,omitempty"`
+
+	// FallbackStatus and FallbackBody answer the client when, with
+	// TransformResponse, the upstream body isn't a valid Lambda proxy
+	// response (e.g. a stack trace). Unset, the client gets a 502 JSON error.
+	// FallbackStatus must be a final status, 200-999.
+	FallbackStatus int    `json:"fallbackStatus,omitempty"`
+	FallbackBody   string `json:"fallbackBody,omitempty"`
+
+	// MaxResponseBytes caps the buffered upstream response when
+	// TransformResponse is on; larger responses are answered with 502. Zero
+	// means unlimited.
+	MaxResponseBytes int64 `json:"maxResponseBytes,omitempty"`
+
+	// ValidateResponse, with TransformResponse, answers 502 when the upstream
+	// response doesn't look like a Lambda proxy response (no statusCode).
+	ValidateResponse bool `json:"validateResponse,omitempty"`
+
+	// TrustedProxies lists CIDR ranges (or single IPs) of proxies whose
+	// X-Forwarded-For entries are trusted when resolving the source IP.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+
+	// UseXForwardedFor takes the leftmost X-Forwarded-For address as the
+	// source IP without any trust checks. Only use it behind a proxy that
+	// overwrites the header.
+	UseXForwardedFor bool `json:"useXForwardedFor,omitempty"`
+
+	// SourceIPHeader names a header (e.g. CF-Connecting-IP) carrying the
+	// client IP. When set and present it takes precedence over
+	// X-Forwarded-For and the connection address.
+	SourceIPHeader string `json:"sourceIpHeader,omitempty"`
+
+	// HeaderKeyCase controls the casing of keys in the event's headers map:
+	// "canonical" (Go's Title-Case) or "lower". It defaults to "lower" for
+	// 2.0 and function URL events and "canonical" for 1.0 events. The
+	// original wire casing isn't available once net/http has parsed the
+	// request.
+	HeaderKeyCase string `json:"headerKeyCase,omitempty"`
+
+	// EventKeyStyle names the event's own keys: "camel" (API Gateway's
+	// rawQueryString, default) or "snake" (raw_query_string). Header, query,
+	// path parameter and claim names are data and keep their spelling.
+	EventKeyStyle string `json:"eventKeyStyle,omitempty"`
+
+	// ForwardHeaders is an allowlist of header names (case-insensitive) copied
+	// into the event. When empty, all headers are copied.
+	ForwardHeaders []string `json:"forwardHeaders,omitempty"`
+
+	// StripHeaders lists header names (case-insensitive) removed from the
+	// event. It takes precedence over ForwardHeaders.
+	StripHeaders []string `json:"stripHeaders,omitempty"`
+
+	// InjectHeaders adds fixed headers, e.g. X-Env: prod, to every
+	// transformed request and so to the event. A header the client already
+	// sent is kept unless OverwriteInjectedHeaders is set.
+	InjectHeaders            map[string]string `json:"injectHeaders,omitempty"`
+	OverwriteInjectedHeaders bool              `json:"overwriteInjectedHeaders,omitempty"`
+
+	// PromoteQueryToHeader maps query parameter names to header names; a
+	// parameter's value is copied into the header before the event is built.
+	// PromoteHeaderToQuery does the reverse, mapping header names to query
+	// parameter names. Existing destination values are never replaced.
+	PromoteQueryToHeader map[string]string `json:"promoteQueryToHeader,omitempty"`
+	PromoteHeaderToQuery map[string]string `json:"promoteHeaderToQuery,omitempty"`
+
+	// StripHostHeader keeps Host out of the event headers; the host is still
+	// reported as requestContext.domainName.
+	StripHostHeader bool `json:"stripHostHeader,omitempty"`
+
+	// StripHeaderPrefixes removes every header whose name starts with one of
+	// these prefixes (case-insensitive), e.g. "X-Forwarded-". Like
+	// StripHeaders it takes precedence over ForwardHeaders.
+	StripHeaderPrefixes []string `json:"stripHeaderPrefixes,omitempty"`
+
+	// InlineJSONBody adds the parsed body as bodyJSON when the request
+	// Content-Type is JSON. The string body is kept as well.
+	InlineJSONBody bool `json:"inlineJsonBody,omitempty"`
+
+	// ParseFormBody adds formParameters (each key to all of its values) when
+	// the request is application/x-www-form-urlencoded. The raw body is kept.
+	ParseFormBody bool `json:"parseFormBody,omitempty"`
+
+	// SortEventKeys re-encodes the payload so object keys are sorted at every
+	// level, including template output and bodyJSON, giving byte-identical
+	// events for identical requests (e.g. for HMAC signing).
+	SortEventKeys bool `json:"sortEventKeys,omitempty"`
+
+	// StreamBody splices the client body into the event while it is sent
+	// upstream instead of buffering it, keeping memory flat for large
+	// uploads. The event is then sent with chunked encoding, and
+	// inlineJsonBody doesn't apply.
+	StreamBody bool `json:"streamBody,omitempty"`
+
+	// SpillBodyBytes buffers bodies larger than this many bytes in a temp
+	// file instead of memory. The body is checked against MaxBodyBytes and
+	// Content-Length before anything is sent, then streamed into the event
+	// from disk as with StreamBody. Zero keeps every body in memory.
+	SpillBodyBytes int64 `json:"spillBodyBytes,omitempty"`
+
+	// CompressEvent gzips buffered events of at least CompressEventBytes
+	// (default 1 KiB) and sends them with Content-Encoding: gzip. Only use
+	// it when the upstream accepts compressed requests.
+	CompressEvent      bool  `json:"compressEvent,omitempty"`
+	CompressEventBytes int64 `json:"compressEventBytes,omitempty"`
+
+	// BodyInlineLimit leaves bodies larger than this many bytes out of the
+	// event: body is empty, bodyTooLarge is true, and the request is sent as
+	// multipart/mixed with the event and the raw body as separate parts.
+	// Zero inlines every body.
+	BodyInlineLimit int64 `json:"bodyInlineLimit,omitempty"`
+
+	// LenientContentLength logs bodies whose size differs from their
+	// Content-Length and continues, instead of answering 400.
+	LenientContentLength bool `json:"lenientContentLength,omitempty"`
+
+	// MaxBodyBytes rejects request bodies larger than this with 413. Zero
+	// means unlimited.
+	MaxBodyBytes int64 `json:"maxBodyBytes,omitempty"`
+
+	// DecompressRequest gunzips request bodies sent with Content-Encoding:
+	// gzip before placing them in the event. MaxBodyBytes applies to the
+	// decompressed size.
+	DecompressRequest bool `json:"decompressRequest,omitempty"`
+
+	// MaxHeaderCount and MaxHeaderBytes reject requests whose headers exceed
+	// these limits with 431. The count includes every value; the size sums
+	// header names and comma-joined values. Only the client's headers are
+	// counted, not injected or promoted ones. Zero means unlimited.
+	MaxHeaderCount int `json:"maxHeaderCount,omitempty"`
+	MaxHeaderBytes int `json:"maxHeaderBytes,omitempty"`
+
+	// TextContentTypes lists extra media types whose bodies are passed as raw
+	// strings instead of being base64-encoded.
+	TextContentTypes []string `json:"textContentTypes,omitempty"`
+
+	// BinaryMediaTypes lists media types that are always base64-encoded, like
+	// API Gateway's binaryMediaTypes. Entries may be wildcards such as
+	// "image/*" or "*/*". They win over TextContentTypes. Empty uses
+	// defaultBinaryMediaTypes.
+	BinaryMediaTypes []string `json:"binaryMediaTypes,omitempty"`
+}
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
-	return &Config{}
+	return &Config{
+		Stage:     defaultContextValue,
+		AccountID: defaultContextValue,
+		APIID:     defaultContextValue,
+
+		EventFormat:    eventFormatAPIGateway,
+		PayloadVersion: payloadVersion2,
+
+		RequestIDHeader:      defaultRequestIDHeader,
+		RequestIDVersion:     requestIDVersion4,
+		InvokePath:           defaultInvokePath,
+		OriginalMethodHeader: defaultOriginalMethodHeader,
+		ForwardContentType:   defaultForwardContentType,
+
+		OptOutHeader: defaultOptOutHeader,
+		MaxBodyBytes: defaultMaxBodyBytes,
+	}
 }
 
 // RequestTransformer is the middleware that will modify requests.
 type LambdaRequestTransformer struct {
 	next http.Handler
 	name string
+
+	skipPaths        []string
+	transformMethods map[string]bool
+	optOutHeader     string
+
+	allowOrigins []string
+	// allowMethods and allowHeaders are pre-joined header values
+	allowMethods string
+	allowHeaders string
+
+	stage     string
+	accountID string
+	apiID     string
+
+	domainName     string
+	fallbackDomain string
+	stageVariables map[string]string
+
+	eventFormat            string
+	payloadVersion         string
+	targetGroupARN         string
+	includeMiddlewareName  bool
+	includeRawRequestURL   bool
+	routerName             string
+	includeMultiValueQuery bool
+	basePath               string
+	timeLayout             string
+	routeTemplate          *routeTemplate
+	routeKey               string
+	trailingSlashMode      string
+	eventTemplate          *template.Template
+
+	jwtAuthorizer     bool
+	authorizerHeaders map[string]string
+	clientCert        bool
+	identitySources   []identitySource
+
+	requestIDHeader      string
+	requestIDVersion     string
+	requestIDFormat      string
+	requestIDPrefix      string
+	requestIDSuffix      string
+	requestIDTrailer     bool
+	invokePath           string
+	keepOriginalPath     bool
+	preserveQuery        bool
+	forwardedHost        bool
+	originalMethodHeader string
+	forwardContentType   string
+	transformResponse    bool
+	verboseErrors        bool
+	dryRun               bool
+	validateResponse     bool
+	maxResponseBytes     int64
+	fallbackStatus       int
+	fallbackBody         string
+
+	trustedProxies   []*net.IPNet
+	sourceIPHeader   string
+	useXForwardedFor bool
+
+	headerKeyCase  string
+	eventKeyStyle  string
+	forwardHeaders map[string]bool
+	stripHeaders   map[string]bool
+	stripHost      bool
+
+	injectedHeaders   map[string]string
+	overwriteInjected bool
+	// promotions are sorted by source name so the outcome is deterministic
+	promoteQueryToHeader []promotion
+	promoteHeaderToQuery []promotion
+	// stripHeaderPrefixes are lowercased
+	stripHeaderPrefixes []string
+	maxHeaderCount      int
+	maxHeaderBytes      int
+
+	inlineJSONBody bool
+	parseFormBody  bool
+	sortEventKeys  bool
+	streamBody     bool
+	spillBodyBytes int64
+
+	compressEvent      bool
+	compressEventBytes int64
+
+	bodyInlineLimit int64
+
+	lenientContentLength bool
+	maxBodyBytes         int64
+	decompressRequest    bool
+	textContentTypes     map[string]bool
+	binaryMediaTypes     []string
+
+	logRequests bool
+	logger      *log.Logger
+
+	// metrics is nil unless enabled
+	metrics     *metrics
+	metricsPath string
+
+	// OnError, when set, is called with every transformation error before
+	// the error response is written. It lets programs embedding the handler
+	// observe failures; it is not configurable from Traefik.
+	OnError func(req *http.Request, err error)
+
+	// nowFunc supplies the event timestamp; tests may override it.
+	nowFunc func() time.Time
 }
 
 // New initializes the plugin instance.
 func New(ctx context.Context, next http.Handler, config *Config, name string) (http.Handler, error) {
-	// No config fields to validate in this plugin.
+	rt, err := NewHandler(next, config)
+	if err != nil {
+		return nil, err
+	}
+	rt.name = name
+	return rt, nil
+}
+
+// defaultName identifies handlers built outside Traefik in log lines.
+const defaultName = "lambdarequesttransformer"
+
+// NewHandler builds the transformer as plain net/http middleware, for use
+// outside Traefik. next is required; a nil config means CreateConfig's
+// defaults. Every option that needs parsing (templates, CIDRs, identity
+// sources, header sets) is validated and compiled here, once, so invalid
+// configs fail at startup and ServeHTTP only reads the results.
+func NewHandler(next http.Handler, config *Config) (*LambdaRequestTransformer, error) {
+	// Catch this here rather than as a panic on the first request
+	if next == nil {
+		return nil, errors.New("next handler must not be nil")
+	}
+	if config == nil {
+		config = CreateConfig()
+	}
+
+	format := orDefault(config.EventFormat, eventFormatAPIGateway)
+	switch format {
+	case eventFormatAPIGateway, eventFormatALB, eventFormatFunctionURL:
+	default:
+		return nil, fmt.Errorf("unsupported eventFormat %q: must be %q, %q or %q",
+			format, eventFormatAPIGateway, eventFormatALB, eventFormatFunctionURL)
+	}
+
+	version := orDefault(config.PayloadVersion, payloadVersion2)
+	if version != payloadVersion1 && version != payloadVersion2 {
+		return nil, fmt.Errorf("unsupported payloadVersion %q: must be %q or %q", version, payloadVersion1, payloadVersion2)
+	}
+
+	trusted, err := parseCIDRs(config.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	binaryTypes := defaultBinaryMediaTypes
+	if len(config.BinaryMediaTypes) > 0 {
+		binaryTypes = lowerAll(config.BinaryMediaTypes)
+		for i, t := range binaryTypes {
+			binaryTypes[i] = strings.TrimSpace(t)
+		}
+	}
+
+	textTypes := make(map[string]bool, len(config.TextContentTypes))
+	for _, ct := range config.TextContentTypes {
+		textTypes[strings.ToLower(strings.TrimSpace(ct))] = true
+	}
+
+	// HTTP API and function URL events lowercase header names; REST API
+	// events keep them as received
+	keyCase := config.HeaderKeyCase
+	if keyCase == "" {
+		keyCase = headerCaseLower
+		if format == eventFormatAPIGateway && version == payloadVersion1 {
+			keyCase = headerCaseCanonical
+		}
+	}
+	if keyCase != headerCaseCanonical && keyCase != headerCaseLower {
+		return nil, fmt.Errorf("unsupported headerKeyCase %q: must be %q or %q", keyCase, headerCaseCanonical, headerCaseLower)
+	}
+
+	slashMode := orDefault(config.TrailingSlash, trailingSlashPreserve)
+	if slashMode != trailingSlashPreserve && slashMode != trailingSlashStrip && slashMode != trailingSlashAdd {
+		return nil, fmt.Errorf("unsupported trailingSlash %q: must be %q, %q or %q",
+			slashMode, trailingSlashPreserve, trailingSlashStrip, trailingSlashAdd)
+	}
+
+	compressBytes := config.CompressEventBytes
+	if compressBytes <= 0 {
+		compressBytes = defaultCompressEventBytes
+	}
+
+	keyStyle := orDefault(config.EventKeyStyle, keyStyleCamel)
+	if keyStyle != keyStyleCamel && keyStyle != keyStyleSnake {
+		return nil, fmt.Errorf("unsupported eventKeyStyle %q: must be %q or %q", keyStyle, keyStyleCamel, keyStyleSnake)
+	}
+
+	idVersion := orDefault(config.RequestIDVersion, requestIDVersion4)
+	if idVersion != requestIDVersion4 && idVersion != requestIDVersion7 {
+		return nil, fmt.Errorf("unsupported requestIdVersion %q: must be %q or %q", idVersion, requestIDVersion4, requestIDVersion7)
+	}
+	// A 1xx is informational: the client would get a 200 after it
+	if config.FallbackStatus != 0 && (config.FallbackStatus < 200 || config.FallbackStatus > 999) {
+		return nil, fmt.Errorf("invalid fallbackStatus %d: must be an HTTP status in 200-999", config.FallbackStatus)
+	}
+
+	idFormat := orDefault(config.RequestIDFormat, requestIDFormatUUID)
+	if idFormat != requestIDFormatUUID && idFormat != requestIDFormatAPIGW {
+		return nil, fmt.Errorf("unsupported requestIdFormat %q: must be %q or %q", idFormat, requestIDFormatUUID, requestIDFormatAPIGW)
+	}
+
+	layout := config.TimeFormat
+	switch layout {
+	case "":
+		layout = time.RFC3339
+	case timeFormatAPIGateway:
+		layout = apiGatewayTimeLayout
+	}
+
+	var route *routeTemplate
+	if config.RouteTemplate != "" {
+		if route, err = parseRouteTemplate(config.RouteTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	var identitySources []identitySource
+	if len(config.IdentitySources) > 0 {
+		if identitySources, err = parseIdentitySources(config.IdentitySources); err != nil {
+			return nil, err
+		}
+	}
+
+	var tmpl *template.Template
+	if config.EventTemplate != "" {
+		if tmpl, err = parseEventTemplate(config.EventTemplate); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.MaxBodyBytes < 0 || config.MaxHeaderCount < 0 || config.MaxHeaderBytes < 0 || config.MaxResponseBytes < 0 {
+		return nil, errors.New("maxBodyBytes, maxHeaderCount, maxHeaderBytes and maxResponseBytes must not be negative")
+	}
+
+	var stats *metrics
+	if config.Metrics {
+		RegisterMetrics()
+		stats = sharedStats
+	}
+
 	return &LambdaRequestTransformer{
 		next: next,
-		name: name,
+		name: defaultName,
+
+		skipPaths:        config.SkipPaths,
+		transformMethods: methodSet(config.TransformMethods),
+		optOutHeader:     http.CanonicalHeaderKey(orDefault(config.OptOutHeader, defaultOptOutHeader)),
+
+		allowOrigins: config.AllowOrigins,
+		allowMethods: strings.Join(config.AllowMethods, ", "),
+		allowHeaders: strings.Join(config.AllowHeaders, ", "),
+
+		stage:     orDefault(config.Stage, defaultContextValue),
+		accountID: orDefault(config.AccountID, defaultContextValue),
+		apiID:     orDefault(config.APIID, defaultContextValue),
+
+		domainName:     config.DomainName,
+		fallbackDomain: orDefault(config.FallbackDomainName, defaultFallbackDomainName),
+		stageVariables: config.StageVariables,
+
+		eventFormat:            format,
+		payloadVersion:         version,
+		targetGroupARN:         config.TargetGroupARN,
+		includeMiddlewareName:  config.IncludeMiddlewareName,
+		includeRawRequestURL:   config.IncludeRawRequestURL,
+		routerName:             config.RouterName,
+		includeMultiValueQuery: config.IncludeMultiValueQuery,
+		basePath:               normalizeBasePath(config.BasePath),
+		timeLayout:             layout,
+		routeTemplate:          route,
+		routeKey:               config.RouteKey,
+		trailingSlashMode:      slashMode,
+		eventTemplate:          tmpl,
+
+		jwtAuthorizer:     config.JWTAuthorizer,
+		authorizerHeaders: canonicalKeys(config.AuthorizerContextHeaders),
+		clientCert:        config.ClientCert,
+		identitySources:   identitySources,
+
+		requestIDHeader:      http.CanonicalHeaderKey(orDefault(config.RequestIDHeader, defaultRequestIDHeader)),
+		requestIDTrailer:     config.RequestIDTrailer,
+		requestIDVersion:     idVersion,
+		requestIDFormat:      idFormat,
+		requestIDPrefix:      config.RequestIDPrefix,
+		requestIDSuffix:      config.RequestIDSuffix,
+		invokePath:           orDefault(config.InvokePath, defaultInvokePath),
+		keepOriginalPath:     config.KeepOriginalPath,
+		preserveQuery:        config.PreserveQuery,
+		forwardedHost:        config.ForwardedHost,
+		originalMethodHeader: http.CanonicalHeaderKey(orDefault(config.OriginalMethodHeader, defaultOriginalMethodHeader)),
+		forwardContentType:   orDefault(config.ForwardContentType, defaultForwardContentType),
+		transformResponse:    config.TransformResponse,
+		verboseErrors:        config.VerboseErrors,
+		dryRun:               config.DryRun,
+		validateResponse:     config.ValidateResponse,
+		maxResponseBytes:     config.MaxResponseBytes,
+		fallbackStatus:       config.FallbackStatus,
+		fallbackBody:         config.FallbackBody,
+
+		trustedProxies:   trusted,
+		sourceIPHeader:   http.CanonicalHeaderKey(config.SourceIPHeader),
+		useXForwardedFor: config.UseXForwardedFor,
+
+		headerKeyCase:  keyCase,
+		eventKeyStyle:  keyStyle,
+		forwardHeaders: canonicalSet(config.ForwardHeaders),
+		stripHeaders:   canonicalSet(config.StripHeaders),
+		stripHost:      config.StripHostHeader,
+
+		injectedHeaders:      canonicalKeys(config.InjectHeaders),
+		overwriteInjected:    config.OverwriteInjectedHeaders,
+		promoteQueryToHeader: sortedPromotions(config.PromoteQueryToHeader),
+		promoteHeaderToQuery: sortedPromotions(config.PromoteHeaderToQuery),
+		maxHeaderCount:       config.MaxHeaderCount,
+		maxHeaderBytes:       config.MaxHeaderBytes,
+
+		stripHeaderPrefixes: lowerAll(config.StripHeaderPrefixes),
+
+		inlineJSONBody: config.InlineJSONBody,
+		sortEventKeys:  config.SortEventKeys,
+		streamBody:     config.StreamBody,
+		spillBodyBytes: config.SpillBodyBytes,
+
+		compressEvent:      config.CompressEvent,
+		compressEventBytes: compressBytes,
+
+		bodyInlineLimit: config.BodyInlineLimit,
+
+		lenientContentLength: config.LenientContentLength,
+		maxBodyBytes:         config.MaxBodyBytes,
+		decompressRequest:    config.DecompressRequest,
+		textContentTypes:     textTypes,
+		binaryMediaTypes:     binaryTypes,
+
+		logRequests: config.Log,
+		logger:      log.New(os.Stderr, "lambdarequesttransformer: ", log.LstdFlags),
+
+		metrics:     stats,
+		metricsPath: config.MetricsPath,
+
+		nowFunc: time.Now,
 	}, nil
 }
 
+// normalizeBasePath gives a base path a leading slash and no trailing one,
+// so it can be prefixed to a request path. "" and "/" yield "".
+func normalizeBasePath(p string) string {
+	p = strings.Trim(p, "/")
+	if p == "" {
+		return ""
+	}
+	return "/" + p
+}
+
+// trailingSlash applies the TrailingSlash mode to path. The root "/" is
+// left alone in every mode.
+func (rt *LambdaRequestTransformer) trailingSlash(path string) string {
+	if path == "" || path == "/" {
+		return path
+	}
+	switch rt.trailingSlashMode {
+	case trailingSlashStrip:
+		if trimmed := strings.TrimRight(path, "/"); trimmed != "" {
+			return trimmed
+		}
+		return "/"
+	case trailingSlashAdd:
+		if !strings.HasSuffix(path, "/") {
+			return path + "/"
+		}
+	}
+	return path
+}
+
+// requestIDKey is the context key under which the request id is cached.
+type requestIDKey struct{}
+
+// RequestIDFromContext returns the Lambda request id assigned to a request
+// by this middleware, for use by handlers further down the chain.
+func RequestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok && id != ""
+}
+
+// lowerAll returns a lowercased copy of values.
+func lowerAll(values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	out := make([]string, len(values))
+	for i, v := range values {
+		out[i] = strings.ToLower(v)
+	}
+	return out
+}
+
+// orDefault returns value, or def when value is empty.
+func orDefault(value, def string) string {
+	if value == "" {
+		return def
+	}
+	return value
+}
+
 // ServeHTTP is called for each request. It transforms the request and forwards it.
 func (rt *LambdaRequestTransformer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if rt.metrics != nil && rt.metricsPath != "" && req.URL.Path == rt.metricsPath {
+		rt.metrics.ServeHTTP(rw, req)
+		return
+	}
+
+	// Preflights are answered here since Lambda handlers rarely expect OPTIONS
+	if len(rt.allowOrigins) > 0 && isPreflight(req) {
+		rt.servePreflight(rw, req)
+		return
+	}
+
+	if rt.bypass(req) {
+		rt.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// Timestamp (ISO 8601) and epoch milliseconds
+	now := rt.nowFunc().UTC()
+
+	// Reuse the caller's request ID for trace correlation, then one cached by
+	// an earlier pass over this request, else mint a UUID. It is settled
+	// first so error responses can carry it too.
+	requestID := req.Header.Get(rt.requestIDHeader)
+	if requestID == "" {
+		requestID, _ = RequestIDFromContext(req.Context())
+	}
+	if requestID == "" {
+		requestID = rt.requestIDPrefix + rt.newRequestID(now) + rt.requestIDSuffix
+	}
+	rw.Header().Set(rt.requestIDHeader, requestID)
+	ctx := context.WithValue(req.Context(), requestIDKey{}, requestID)
+	// Logged in place of the rewritten POST to the invoke path
+	ctx = context.WithValue(ctx, clientRequestKey{}, clientRequest{method: req.Method, path: req.URL.Path})
+	req = req.WithContext(ctx)
+
 	// Save original details
 	origMethod := req.Method
 	origPath := req.URL.Path
-	origQuery := req.URL.RawQuery
 	origHost := req.Host
 
-	// Copy all incoming headers into a map (combine multiple values by comma).
-	headersMap := make(map[string]string)
-	for h, values := range req.Header {
-		headersMap[h] = strings.Join(values, ",")
+	built, err := rt.buildEvent(req, now, requestID)
+	if err != nil {
+		var te *transformError
+		if !errors.As(err, &te) {
+			te = &transformError{status: http.StatusInternalServerError, msg: "internal error building Lambda event", err: err}
+		}
+		if te.status == statusClientClosedRequest {
+			// Not an error worth reporting, and nobody reads a body
+			rw.WriteHeader(statusClientClosedRequest)
+			return
+		}
+		rt.fail(rw, req, te.status, te.msg, te.err)
+		return
 	}
+	defer built.release()
+	body, stream, info, jsonData := built.body, built.stream, built.info, built.payload
 
-	// Determine client source IP
-	clientIP := ""
-	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		clientIP = ip
+	rt.metrics.observe(len(jsonData))
+	if rt.logRequests {
+		rt.logger.Printf("name=%s method=%s path=%q requestId=%s payloadBytes=%d base64=%t",
+			rt.name, origMethod, origPath, requestID, len(jsonData), info.isBase64)
+	}
+
+	// Show the event instead of invoking Lambda
+	if rt.dryRun {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.WriteHeader(http.StatusOK)
+		if stream != nil {
+			event := rt.eventReader(jsonData, stream)
+			defer event.Close()
+			_, _ = io.Copy(rw, event)
+			return
+		}
+		_, _ = rw.Write(jsonData)
+		return
+	}
+
+	// Replace the request body with the JSON payload
+	contentType := rt.forwardContentType
+	contentEncoding := ""
+	switch {
+	case stream != nil:
+		// Length unknown: the transport falls back to chunked encoding.
+		// Closing the reader once next returns stops the writing goroutine
+		// even if next never read or closed the body.
+		event := rt.eventReader(jsonData, stream)
+		defer event.Close()
+		req.Body = event
+		req.GetBody = nil // the stream can't be replayed
+		req.ContentLength = -1
+		req.Header.Del("Content-Length")
+	case info.bodyTooLarge:
+		// Send the event and the raw body side by side
+		payload, mixedType, err := multipartEvent(jsonData, body, req.Header.Get("Content-Type"))
+		if err != nil {
+			rt.fail(rw, req, http.StatusInternalServerError, "internal error building Lambda event", fmt.Errorf("event encoding: %w", err))
+			return
+		}
+		contentType = mixedType
+		setRequestBody(req, payload)
+	default:
+		payload := jsonData
+		if rt.compressEvent && int64(len(jsonData)) >= rt.compressEventBytes {
+			compressed, err := gzipBytes(jsonData)
+			if err != nil {
+				rt.fail(rw, req, http.StatusInternalServerError, "internal error building Lambda event", fmt.Errorf("event compression: %w", err))
+				return
+			}
+			payload = compressed
+			contentEncoding = "gzip"
+		}
+		setRequestBody(req, payload)
+	}
+	req.Header.Set("Content-Type", contentType)
+	// The event is identity-encoded JSON, whatever the client sent, unless
+	// it was compressed above
+	req.Header.Del("Content-Encoding")
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	req.Header.Del("Transfer-Encoding")
+	// Always set, so a client-supplied value can't masquerade as the original
+	req.Header.Set(rt.originalMethodHeader, origMethod)
+	req.Method = http.MethodPost // Override method to POST
+	req.TransferEncoding = nil   // Disable chunked transfer if it was set
+
+	// Set URL path to Lambda invocation format. RequestURI must stay empty:
+	// the forwarding http.Client rejects requests that set it.
+	if !rt.keepOriginalPath {
+		req.URL.Path = rt.invokePath
+		req.URL.RawPath = ""
+	}
+	req.RequestURI = ""
+	if !rt.preserveQuery {
+		req.URL.RawQuery = "" // already captured as rawQueryString
+	}
+
+	// The client's Host means nothing to the Lambda runtime; clearing it lets
+	// the transport derive Host from the upstream URL. The original host is
+	// already in requestContext.domainName.
+	if rt.forwardedHost && origHost != "" && req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", origHost)
+	}
+	req.Host = ""
+
+	// Trailers must be announced before the first write and filled in after
+	if rt.requestIDTrailer {
+		rw.Header().Add("Trailer", requestIDTrailer)
+		rw = &trailerWriter{ResponseWriter: rw}
+	}
+
+	// Call the next handler (forward to the upstream service)
+	if !rt.transformResponse {
+		rt.next.ServeHTTP(rw, req)
 	} else {
-		clientIP = req.RemoteAddr
+		rec := newResponseRecorder(rt.maxResponseBytes)
+		rt.next.ServeHTTP(rec, req)
+		rt.writeLambdaResponse(rw, req, rec, origMethod == http.MethodHead)
 	}
 
-	// Get User-Agent and x-session-id (if any)
-	userAgent := req.Header.Get("User-Agent")
-	sessionID := req.Header.Get("x-session-id")
-	identitySrc := []string{}
-	if sessionID != "" {
-		identitySrc = append(identitySrc, sessionID)
+	if rt.requestIDTrailer {
+		rw.Header().Set(requestIDTrailer, requestID)
+	}
+}
+
+// statusClientClosedRequest is the non-standard 499 (from nginx) recorded
+// when the client disconnects or a deadline passes before the request is
+// forwarded: nobody is waiting for the Lambda's answer.
+const statusClientClosedRequest = 499
+
+// newRequestInfo gathers what the event builders need from a request that
+// has not been rewritten yet. body is the buffered client body, or nil when
+// stream carries it.
+func (rt *LambdaRequestTransformer) newRequestInfo(req *http.Request, body []byte, stream *streamedBody, requestID string, now time.Time) *requestInfo {
+	// Copy the forwarded headers into a map (combine multiple values by comma).
+	header := rt.eventHeader(req)
+	headersMap := make(map[string]string, len(header))
+	for h, values := range header {
+		headersMap[rt.headerKey(h)] = strings.Join(values, ",")
 	}
 
+	// Determine client source IP
+	clientIP := rt.sourceIP(req)
+
+	userAgent := req.Header.Get("User-Agent")
+	query := req.URL.Query() // URL-decoded
+	identitySrc := rt.identitySourceValues(req, query)
+
 	// Parse host into domain name and prefix (subdomain)
-	domainName := origHost
-	domainPrefix := ""
-	if colonIdx := strings.Index(origHost, ":"); colonIdx != -1 {
-		domainName = origHost[:colonIdx] // remove port if present
-	}
-	parts := strings.Split(domainName, ".")
-	if len(parts) > 1 {
-		domainPrefix = parts[0]
-	} else {
-		domainPrefix = domainName
+	domainSource := req.Host
+	if rt.domainName != "" {
+		domainSource = rt.domainName
 	}
+	if domainSource == "" {
+		domainSource = rt.fallbackDomain
+	}
+	domainName, domainPrefix := parseDomain(domainSource)
 
-	// Generate a unique request ID (UUIDv4)
-	requestID := generateUUID()
+	// Binary payloads are base64-encoded, as API Gateway does
+	bodyStr := string(body)
+	isBase64 := false
+	// Bodies over the inline limit are left out of the event and sent
+	// alongside it instead
+	bodyTooLarge := stream == nil && rt.bodyInlineLimit > 0 && int64(len(body)) > rt.bodyInlineLimit
+	if stream != nil {
+		bodyStr = stream.placeholder
+		isBase64 = stream.base64
+	} else if bodyTooLarge {
+		bodyStr = ""
+	} else if len(body) > 0 && (hasContentEncoding(req.Header) ||
+		!rt.isTextContentType(sniffContentType(req.Header.Get("Content-Type"), body)) ||
+		!utf8.Valid(body)) {
+		// A string field can't carry invalid UTF-8 without mangling it
+		bodyStr = base64.StdEncoding.EncodeToString(body)
+		isBase64 = true
+	}
 
-	// Timestamp (ISO 8601) and epoch milliseconds
-	now := time.Now().UTC()
-	timeStr := now.Format(time.RFC3339)
-	timeEpoch := now.UnixNano() / 1e6
-
-	// Construct the JSON event body
-	event := map[string]interface{}{
-		"version":        "2.0",
-		"type":           "REQUEST",
-		"routeKey":       fmt.Sprintf("%s %s", origMethod, origPath),
-		"rawPath":        origPath,
-		"rawQueryString": origQuery,
-		"headers":        headersMap,
-		"requestContext": map[string]interface{}{
-			"accountId":    "local",
-			"apiId":        "local",
-			"domainName":   domainName,
-			"domainPrefix": domainPrefix,
-			"http": map[string]interface{}{
-				"method":    origMethod,
-				"path":      origPath,
-				"protocol":  req.Proto, // e.g. "HTTP/1.1"
-				"sourceIp":  clientIP,
-				"userAgent": userAgent,
-			},
-			"requestId": requestID,
-			"routeKey":  fmt.Sprintf("%s %s", origMethod, origPath),
-			"stage":     "local",
-			"time":      timeStr,
-			"timeEpoch": timeEpoch,
-		},
-		"body":            "",
-		"isBase64Encoded": false,
-		"identitySource":  identitySrc,
-	}
-
-	// Serialize the event to JSON
-	jsonData, err := json.Marshal(event)
+	// The event sees the path as it was before any prefix stripping. The
+	// joined path is normalized again: BasePath "/v1" plus "/" must not
+	// leave a trailing slash in strip mode.
+	routePath := rt.trailingSlash(req.URL.Path)
+	eventPath := rt.trailingSlash(rt.basePath + routePath)
+
+	// Match the configured route template, if any
+	routeKey := fmt.Sprintf("%s %s", req.Method, eventPath)
+	var pathParams map[string]string
+	resource := eventPath
+	if rt.routeTemplate != nil {
+		if params, ok := rt.routeTemplate.match(routePath); ok {
+			routeKey = fmt.Sprintf("%s %s", req.Method, rt.routeTemplate.raw)
+			pathParams = params
+			resource = rt.routeTemplate.raw
+		}
+	}
+	if rt.routeKey != "" {
+		routeKey = rt.routeKey
+	}
+
+	scheme := rt.scheme(req)
+
+	return &requestInfo{
+		method:       req.Method,
+		path:         eventPath,
+		rawQuery:     req.URL.RawQuery,
+		routeKey:     routeKey,
+		resource:     resource,
+		pathParams:   pathParams,
+		query:        query,
+		header:       header,
+		headers:      headersMap,
+		domainName:   domainName,
+		domainPrefix: domainPrefix,
+		protocol:     req.Proto, // e.g. "HTTP/1.1"
+		scheme:       scheme,
+		sourceIP:     clientIP,
+		userAgent:    userAgent,
+		// Read from the unfiltered headers so stripHeaders can hide the token
+		authorization: req.Header.Get("Authorization"),
+		authorizerCtx: rt.authorizerContext(req.Header),
+		clientCert:    certIfEnabled(rt.clientCert, req),
+		identitySrc:   identitySrc,
+		cookies:       splitCookies(header),
+		requestID:     requestID,
+		now:           now,
+		body:          bodyStr,
+		isBase64:      isBase64,
+		bodyTooLarge:  bodyTooLarge,
+	}
+}
+
+// rawRequestURL renders the client's URL for requestContext.rawRequestURL,
+// or "" when IncludeRawRequestURL is off. It must run before promote, so
+// promoted header values (possibly credentials) don't show up in it.
+func (rt *LambdaRequestTransformer) rawRequestURL(req *http.Request) string {
+	if !rt.includeRawRequestURL {
+		return ""
+	}
+	raw := rt.scheme(req) + "://" + orDefault(req.Host, rt.fallbackDomain) + req.URL.EscapedPath()
+	if req.URL.RawQuery != "" {
+		raw += "?" + req.URL.RawQuery
+	}
+	return raw
+}
+
+// setRequestBody makes payload the request body. GetBody is replaced too:
+// on client-built requests it would otherwise replay the original body if
+// the transport retries or follows a redirect.
+func setRequestBody(req *http.Request, payload []byte) {
+	req.Body = io.NopCloser(bytes.NewReader(payload))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+	req.ContentLength = int64(len(payload))
+	req.Header.Set("Content-Length", strconv.Itoa(len(payload)))
+}
+
+// gzipWriters recycles gzip writers: each one carries about 1 MB of
+// compressor state, which would otherwise be garbage after every event.
+var gzipWriters = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
+// gzipBytes returns data gzip-compressed.
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errBodyTooLarge is returned by readBody when the body exceeds the limit.
+var errBodyTooLarge = errors.New("request body too large")
+
+// errHeadersTooLarge reports a request over the header count or size limit.
+var errHeadersTooLarge = errors.New("request header fields too large")
+
+// readBody reads and closes the request body, then restores req.Body with the
+// captured bytes so it can still be read downstream. A nil body yields nil.
+func (rt *LambdaRequestTransformer) readBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	defer req.Body.Close()
+
+	// Reject early when the declared length is already over the limit
+	if rt.maxBodyBytes > 0 && req.ContentLength > rt.maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+
+	data, err := rt.readLimited(req.Body)
+	if err == io.ErrUnexpectedEOF && req.ContentLength > 0 {
+		// The client hung up before sending the declared length
+		err = nil
+	}
 	if err != nil {
-		http.Error(rw, "JSON marshal error: "+err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	// A zero ContentLength may mean "unknown" on client-built requests
+	if req.ContentLength > 0 && int64(len(data)) != req.ContentLength {
+		mismatch := &lengthMismatchError{declared: req.ContentLength, actual: int64(len(data))}
+		if !rt.lenientContentLength {
+			return nil, mismatch
+		}
+		rt.logger.Printf("name=%s method=%s path=%q warning=%q", rt.name, req.Method, req.URL.Path, mismatch.Error())
 	}
 
-	// Replace the request body with the JSON payload
-	req.Body = io.NopCloser(strings.NewReader(string(jsonData)))
-	req.ContentLength = int64(len(jsonData))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", fmt.Sprintf("%d", len(jsonData)))
-	req.Method = http.MethodPost // Override method to POST
-	req.TransferEncoding = nil   // Disable chunked transfer if it was set
+	if rt.decompressRequest && strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		// The limit applies to the inflated size to guard against gzip bombs
+		data, err = rt.readLimited(zr)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Del("Content-Encoding")
+		// Keep the event's content-length in step with the inflated body
+		req.Header.Set("Content-Length", strconv.Itoa(len(data)))
+	}
 
-	// Set URL path to Lambda invocation format
-	req.RequestURI = "/2015-03-31/functions/function/invocations"
+	req.Body = io.NopCloser(bytes.NewReader(data))
+	return data, nil
+}
 
-	// Call the next handler (forward to the upstream service)
-	rt.next.ServeHTTP(rw, req)
+// lengthMismatchError reports a body whose size differs from its declared
+// Content-Length.
+type lengthMismatchError struct {
+	declared, actual int64
+}
+
+func (e *lengthMismatchError) Error() string {
+	return fmt.Sprintf("body length mismatch: Content-Length declared %d bytes, read %d (%+d)",
+		e.declared, e.actual, e.actual-e.declared)
+}
+
+// readLimited reads r fully, failing with errBodyTooLarge once more than
+// maxBodyBytes have been read.
+func (rt *LambdaRequestTransformer) readLimited(r io.Reader) ([]byte, error) {
+	if rt.maxBodyBytes > 0 {
+		r = io.LimitReader(r, rt.maxBodyBytes+1)
+	}
+	data, err := io.ReadAll(r)
+	if rt.maxBodyBytes > 0 && int64(len(data)) > rt.maxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	// Partial data is returned with the error so callers can report it
+	return data, err
+}
+
+// isTextContentType reports whether a Content-Type header value denotes a
+// textual payload that can be placed in the event without encoding.
+func (rt *LambdaRequestTransformer) isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	for _, pattern := range rt.binaryMediaTypes {
+		if matchMediaType(pattern, mediaType) {
+			return false
+		}
+	}
+	if err != nil {
+		return false
+	}
+	if rt.textContentTypes[mediaType] {
+		return true
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript",
+		"application/x-www-form-urlencoded", "application/graphql":
+		return true
+	}
+	return false
+}
+
+// hasContentEncoding reports whether the body is still content-encoded,
+// e.g. gzip that DecompressRequest didn't (or couldn't) inflate. Encoded
+// bytes are binary whatever the Content-Type says.
+func hasContentEncoding(header http.Header) bool {
+	ce := strings.TrimSpace(header.Get("Content-Encoding"))
+	return ce != "" && !strings.EqualFold(ce, "identity")
+}
+
+// newRequestID generates a request id in the configured UUID version.
+func (rt *LambdaRequestTransformer) newRequestID(now time.Time) string {
+	if rt.requestIDFormat == requestIDFormatAPIGW {
+		return generateAPIGatewayID()
+	}
+	if rt.requestIDVersion == requestIDVersion7 {
+		return generateUUIDv7(now)
+	}
+	return generateUUID()
+}
+
+// certIfEnabled returns the request's client certificate details when the
+// feature is on.
+func certIfEnabled(enabled bool, req *http.Request) map[string]interface{} {
+	if !enabled {
+		return nil
+	}
+	return clientCertInfo(req.TLS)
+}
+
+// multipartEvent packs the event and the raw client body into a
+// multipart/mixed payload, returning it with its Content-Type.
+func multipartEvent(event, body []byte, bodyType string) ([]byte, string, error) {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+
+	eventPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := eventPart.Write(event); err != nil {
+		return nil, "", err
+	}
+
+	if bodyType == "" {
+		bodyType = "application/octet-stream"
+	}
+	bodyPart, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {bodyType}})
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := bodyPart.Write(body); err != nil {
+		return nil, "", err
+	}
+
+	if err := mw.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), "multipart/mixed; boundary=" + mw.Boundary(), nil
+}
+
+// sniffContentType returns the declared Content-Type, or one detected from
+// the body when the client sent none. The request header is not modified.
+func sniffContentType(declared string, body []byte) string {
+	if declared != "" || len(body) == 0 {
+		return declared
+	}
+	// DetectContentType only looks at the first 512 bytes
+	return http.DetectContentType(body)
+}
+
+// isJSONContentType reports whether a Content-Type header value is JSON.
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// defaultBinaryMediaTypes covers common binary payloads. Non-text types are
+// base64-encoded anyway, so a list only changes behavior when it names text
+// types, e.g. "*/*" or "text/csv".
+var defaultBinaryMediaTypes = []string{
+	"application/octet-stream", "application/pdf", "application/zip", "application/gzip",
+	"image/*", "audio/*", "video/*", "font/*",
+}
+
+// matchMediaType reports whether mediaType matches pattern, which may be
+// "*/*" (anything, even a missing type) or "type/*".
+func matchMediaType(pattern, mediaType string) bool {
+	if pattern == "*/*" {
+		return true
+	}
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(mediaType, pattern[:len(pattern)-1])
+	}
+	return pattern == mediaType
+}
+
+// isFormContentType reports whether contentType is
+// application/x-www-form-urlencoded.
+func isFormContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == "application/x-www-form-urlencoded"
 }
 
 // generateUUID creates a random UUID v4 string.
 func generateUUID() string {
+	b := randomUUIDBytes()
+	// Set UUID version (4) and variant (RFC 4122)
+	b[6] = (b[6] & 0x0F) | 0x40
+	b[8] = (b[8] & 0x3F) | 0x80
+	return formatUUID(b)
+}
+
+// generateUUIDv7 creates a time-ordered UUID v7 string: a 48-bit Unix
+// millisecond timestamp followed by random bits.
+func generateUUIDv7(now time.Time) string {
+	b := randomUUIDBytes()
+	ms := uint64(now.UnixMilli())
+	for i := 0; i < 6; i++ {
+		b[i] = byte(ms >> (40 - 8*i))
+	}
+	// Set UUID version (7) and variant (RFC 4122)
+	b[6] = (b[6] & 0x0F) | 0x70
+	b[8] = (b[8] & 0x3F) | 0x80
+	return formatUUID(b)
+}
+
+// generateAPIGatewayID creates an id shaped like API Gateway HTTP API
+// request ids: 11 random bytes in padded base64, 16 characters ending in "=".
+func generateAPIGatewayID() string {
+	return base64.StdEncoding.EncodeToString(randomUUIDBytes()[:11])
+}
+
+// uuidFallbackCounter makes fallback UUIDs unique within the process even
+// when several are generated in the same clock tick.
+var uuidFallbackCounter uint64
+
+// randomUUIDBytes returns 16 random bytes for a UUID.
+func randomUUIDBytes() []byte {
 	b := make([]byte, 16)
 	_, err := rand.Read(b)
 	if err != nil {
-		// Fallback: use current time to generate pseudo-unique bytes
-		t := time.Now().UnixNano()
-		for i := 0; i < 16; i++ {
-			b[i] = byte(t >> (i * 8))
-		}
+		// Fallback: hash the clock, a process-wide counter and the pid so the
+		// bytes are well mixed and never repeat within this process
+		var seed [24]byte
+		binary.BigEndian.PutUint64(seed[0:8], uint64(time.Now().UnixNano()))
+		binary.BigEndian.PutUint64(seed[8:16], atomic.AddUint64(&uuidFallbackCounter, 1))
+		binary.BigEndian.PutUint64(seed[16:24], uint64(os.Getpid()))
+		sum := sha256.Sum256(seed[:])
+		copy(b, sum[:16])
 	}
-	// Set UUID version (4) and variant (RFC 4122)
-	b[6] = (b[6] & 0x0F) | 0x40
-	b[8] = (b[8] & 0x3F) | 0x80
+	return b
+}
+
+// formatUUID renders 16 bytes in the canonical 8-4-4-4-12 hex layout.
+func formatUUID(b []byte) string {
 	return fmt.Sprintf("%08x-%04x-%04x-%04x-%012x",
 		b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
 }
@@ -0,0 +1,402 @@
+package traefik_lambdarequesttransformer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureEvent runs req through a transformer built from cfg and returns
+// the event JSON the next handler received.
+func captureEvent(t testing.TB, cfg *Config, req *http.Request) map[string]interface{} {
+	t.Helper()
+	var raw []byte
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var err error
+		if raw, err = io.ReadAll(req.Body); err != nil {
+			t.Errorf("reading event: %v", err)
+		}
+	})
+	h, err := New(context.Background(), next, cfg, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if raw == nil {
+		t.Fatalf("next not called, status %d: %s", rec.Code, rec.Body.String())
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(raw, &event); err != nil {
+		t.Fatalf("event is not JSON: %v\n%s", err, raw)
+	}
+	return event
+}
+
+func gzipString(t testing.TB, s string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestEncodedOrInvalidBodiesAreBase64(t *testing.T) {
+	gz := gzipString(t, `{"hello":"world"}`)
+	invalid := []byte("caf\xe9 au lait")
+
+	tests := []struct {
+		name     string
+		body     []byte
+		ct, ce   string
+		setup    func(*Config)
+		wantB64  bool
+		wantBody string
+	}{
+		{name: "identity json", body: []byte(`{"a":1}`), ct: "application/json", ce: "identity", wantBody: `{"a":1}`},
+		{name: "gzip json", body: gz, ct: "application/json", ce: "gzip", wantB64: true},
+		{name: "br text", body: []byte("not really brotli"), ct: "text/plain", ce: "br", wantB64: true},
+		{name: "invalid utf-8 text", body: invalid, ct: "text/plain", wantB64: true},
+		{name: "gzip json inflated", body: gz, ct: "application/json", ce: "gzip",
+			setup: func(c *Config) { c.DecompressRequest = true }, wantBody: `{"hello":"world"}`},
+		{name: "stream gzip json", body: gz, ct: "application/json", ce: "gzip",
+			setup: func(c *Config) { c.StreamBody = true }, wantB64: true},
+		{name: "stream gzip json inflated", body: gz, ct: "application/json", ce: "gzip",
+			setup: func(c *Config) { c.StreamBody = true; c.DecompressRequest = true }, wantBody: `{"hello":"world"}`},
+		{name: "spill gzip json", body: gz, ct: "application/json", ce: "gzip",
+			setup: func(c *Config) { c.SpillBodyBytes = 4 }, wantB64: true},
+		{name: "spill invalid utf-8 text", body: invalid, ct: "text/plain",
+			setup: func(c *Config) { c.SpillBodyBytes = 4 }, wantB64: true},
+		{name: "spill valid text", body: []byte("café au lait"), ct: "text/plain",
+			setup: func(c *Config) { c.SpillBodyBytes = 4 }, wantBody: "café au lait"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := CreateConfig()
+			if tt.setup != nil {
+				tt.setup(cfg)
+			}
+			req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.ct)
+			if tt.ce != "" {
+				req.Header.Set("Content-Encoding", tt.ce)
+			}
+			event := captureEvent(t, cfg, req)
+
+			if got := event["isBase64Encoded"]; got != tt.wantB64 {
+				t.Fatalf("isBase64Encoded = %v, want %v", got, tt.wantB64)
+			}
+			body, _ := event["body"].(string)
+			if tt.wantB64 {
+				decoded, err := base64.StdEncoding.DecodeString(body)
+				if err != nil {
+					t.Fatalf("body is not base64: %v", err)
+				}
+				if !bytes.Equal(decoded, tt.body) {
+					t.Errorf("decoded body = %q, want %q", decoded, tt.body)
+				}
+				return
+			}
+			if body != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestUTF8CheckerSplitSequences(t *testing.T) {
+	text := []byte("naïve – 日本語 ✓")
+	for split := 0; split <= len(text); split++ {
+		var c utf8Checker
+		c.Write(text[:split])
+		c.Write(text[split:])
+		if !c.valid() {
+			t.Errorf("split at %d reported invalid", split)
+		}
+	}
+
+	var c utf8Checker
+	c.Write([]byte("ok\xe6\x97"))
+	if c.valid() {
+		t.Error("truncated sequence reported valid")
+	}
+	c.Write([]byte("\xff"))
+	if c.valid() {
+		t.Error("invalid byte reported valid")
+	}
+}
+
+func TestChunkedGzipRequestIsForwardedWithCleanFraming(t *testing.T) {
+	for _, decompress := range []bool{false, true} {
+		type seen struct {
+			transferEncoding []string
+			contentLength    int64
+			contentEncoding  string
+			body             []byte
+		}
+		got := make(chan seen, 1)
+		upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			got <- seen{r.TransferEncoding, r.ContentLength, r.Header.Get("Content-Encoding"), body}
+		}))
+
+		cfg := CreateConfig()
+		cfg.DecompressRequest = decompress
+		// next forwards over a real connection, as Traefik's proxy would
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			req.URL.Scheme = "http"
+			req.URL.Host = upstream.Listener.Addr().String()
+			res, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Errorf("forwarding: %v", err)
+				return
+			}
+			res.Body.Close()
+		})
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(gzipString(t, `{"hello":"world"}`)))
+		req.ContentLength = -1
+		req.TransferEncoding = []string{"chunked"}
+		req.Header.Set("Transfer-Encoding", "chunked")
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Content-Encoding", "gzip")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		upstream.Close()
+
+		var s seen
+		select {
+		case s = <-got:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("decompress=%t: upstream never received the request", decompress)
+		}
+		if len(s.transferEncoding) != 0 {
+			t.Errorf("decompress=%t: Transfer-Encoding = %v, want none", decompress, s.transferEncoding)
+		}
+		if s.contentLength != int64(len(s.body)) {
+			t.Errorf("decompress=%t: Content-Length = %d, body is %d bytes", decompress, s.contentLength, len(s.body))
+		}
+		if s.contentEncoding != "" {
+			t.Errorf("decompress=%t: Content-Encoding = %q, want identity", decompress, s.contentEncoding)
+		}
+		if !json.Valid(s.body) {
+			t.Errorf("decompress=%t: upstream body is not JSON: %q", decompress, s.body)
+		}
+	}
+}
+
+// closeCounter is a request body that counts Close calls.
+type closeCounter struct {
+	io.Reader
+	closes int
+}
+
+func (c *closeCounter) Close() error {
+	c.closes++
+	return nil
+}
+
+func TestChainedHandlersReadTheEvent(t *testing.T) {
+	var middlewareSaw, finalSaw []byte
+	final := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		finalSaw, _ = io.ReadAll(req.Body)
+	})
+	// A downstream middleware that inspects the body and puts it back
+	inspecting := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		middlewareSaw, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+		req.Body = io.NopCloser(bytes.NewReader(middlewareSaw))
+		final.ServeHTTP(rw, req)
+	})
+	h, err := New(context.Background(), inspecting, CreateConfig(), "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := &closeCounter{Reader: bytes.NewReader([]byte("original bytes"))}
+	req := httptest.NewRequest(http.MethodPost, "/orders", nil)
+	req.Body = original
+	req.ContentLength = int64(len("original bytes"))
+	req.Header.Set("Content-Type", "text/plain")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	for name, got := range map[string][]byte{"middleware": middlewareSaw, "final handler": finalSaw} {
+		var event map[string]interface{}
+		if err := json.Unmarshal(got, &event); err != nil {
+			t.Errorf("%s did not get the event JSON: %v\n%q", name, err, got)
+			continue
+		}
+		if event["body"] != "original bytes" {
+			t.Errorf("%s: event body = %v", name, event["body"])
+		}
+	}
+	if original.closes != 1 {
+		t.Errorf("original body closed %d times, want 1", original.closes)
+	}
+}
+
+func TestCompressEventThreshold(t *testing.T) {
+	for _, size := range []int{10, 4 << 10} {
+		cfg := CreateConfig()
+		cfg.CompressEvent = true
+		var encoding string
+		var payload []byte
+		next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			encoding = req.Header.Get("Content-Encoding")
+			payload, _ = io.ReadAll(req.Body)
+			if req.ContentLength != int64(len(payload)) {
+				t.Errorf("size %d: ContentLength = %d, body is %d bytes", size, req.ContentLength, len(payload))
+			}
+		})
+		h, err := New(context.Background(), next, cfg, "test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(bytes.Repeat([]byte("a"), size)))
+		req.Header.Set("Content-Type", "text/plain")
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		compressed := size >= defaultCompressEventBytes
+		if (encoding == "gzip") != compressed {
+			t.Errorf("size %d: Content-Encoding = %q", size, encoding)
+		}
+		if compressed {
+			zr, err := gzip.NewReader(bytes.NewReader(payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if payload, err = io.ReadAll(zr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !json.Valid(payload) {
+			t.Errorf("size %d: event is not JSON", size)
+		}
+	}
+}
+
+// BenchmarkCompressEvent measures the CPU cost of gzipping events of
+// various sizes and reports the compressed/original size ratio, to judge
+// where CompressEventBytes pays off.
+func BenchmarkCompressEvent(b *testing.B) {
+	rt, err := NewHandler(http.NotFoundHandler(), CreateConfig())
+	if err != nil {
+		b.Fatal(err)
+	}
+	item := []byte(`{"id":"4f6c1a2b","name":"widget","tags":["blue","large"],"price":12.5},`)
+	for _, size := range []int{256, 1 << 10, 16 << 10, 256 << 10, 1 << 20} {
+		body := append([]byte("["), bytes.Repeat(item, size/len(item)+1)[:size]...)
+		req := httptest.NewRequest(http.MethodPost, "/orders", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "text/plain")
+		built, err := rt.buildEvent(req, fixedTime, "req-1")
+		if err != nil {
+			b.Fatal(err)
+		}
+		event := built.payload
+
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(event)))
+			var compressed []byte
+			for i := 0; i < b.N; i++ {
+				if compressed, err = gzipBytes(event); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(compressed))/float64(len(event)), "ratio")
+		})
+	}
+}
+
+func TestNewRejectsInvalidCompiledConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		setup  func(*Config)
+		substr string
+	}{
+		{name: "cidr", setup: func(c *Config) { c.TrustedProxies = []string{"10.0.0.0/33"} }, substr: "10.0.0.0/33"},
+		{name: "template", setup: func(c *Config) { c.EventTemplate = `{"path":{{json .Path}` }, substr: "eventTemplate"},
+		{name: "template field", setup: func(c *Config) { c.EventTemplate = `{"m":{{json .Methd}}}` }, substr: "eventTemplate"},
+		{name: "template not JSON", setup: func(c *Config) { c.EventTemplate = `{"m":{{.Method}}}` }, substr: "eventTemplate"},
+		{name: "route", setup: func(c *Config) { c.RouteTemplate = "users/{id}" }, substr: "routeTemplate"},
+		{name: "informational fallbackStatus", setup: func(c *Config) { c.FallbackStatus = 103 }, substr: "fallbackStatus"},
+		{name: "four-digit fallbackStatus", setup: func(c *Config) { c.FallbackStatus = 1000 }, substr: "fallbackStatus"},
+	}
+	for _, tt := range tests {
+		cfg := CreateConfig()
+		tt.setup(cfg)
+		_, err := New(context.Background(), http.NotFoundHandler(), cfg, "test")
+		if err == nil {
+			t.Errorf("%s: New accepted an invalid config", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.substr) {
+			t.Errorf("%s: error %q does not mention %q", tt.name, err, tt.substr)
+		}
+	}
+}
+
+// BenchmarkCompiledConfig shows that route templates, CIDR lists and event
+// templates are parsed once by NewHandler: "request" is the per-request
+// cost with them configured, "compile" what parsing them would add to it.
+func BenchmarkCompiledConfig(b *testing.B) {
+	cfg := CreateConfig()
+	cfg.RouteTemplate = "/users/{id}/orders/{orderId}"
+	cfg.TrustedProxies = []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fd00::/8"}
+	cfg.EventTemplate = `{"method":{{json .Method}},"path":{{json .Path}},"headers":{{json .Headers}},"body":{{json .Body}},"requestId":{{json .RequestID}}}`
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.Copy(io.Discard, req.Body)
+	})
+	newReq := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/users/42/orders/7", nil)
+		req.RemoteAddr = "10.1.2.3:5000"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		return req
+	}
+
+	b.Run("compile", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := NewHandler(next, cfg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("request", func(b *testing.B) {
+		rt, err := NewHandler(next, cfg)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			rt.ServeHTTP(httptest.NewRecorder(), newReq())
+		}
+	})
+}
+
+func TestNewAcceptsTemplateUsingRequestHeaders(t *testing.T) {
+	cfg := CreateConfig()
+	// A header lookup can't be checked without a request
+	cfg.EventTemplate = `{"m":{{json .Method}},"tenant":{{json .Headers.tenant}}}`
+	if _, err := New(context.Background(), http.NotFoundHandler(), cfg, "test"); err != nil {
+		t.Fatal(err)
+	}
+}